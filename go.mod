@@ -0,0 +1,3 @@
+module github.com/siuxsa/liveurls
+
+go 1.20
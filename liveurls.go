@@ -1,70 +1,683 @@
 package main
 
 import (
+	"archive/zip"
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math/rand"
 	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
+
+	"github.com/siuxsa/liveurls/scan"
 )
 
-type statusResult struct {
-	url        string
-	statusCode int
+// jsonResult is the -json form of a scan.Result. Optional fields are left
+// out when the feature that fills them is off or there was nothing to record
+type jsonResult struct {
+	URL            string    `json:"url"`
+	Input          string    `json:"input,omitempty"` // Only when it differs from url
+	Status         int       `json:"status"`
+	CheckedAt      time.Time `json:"checked_at"`
+	LatencyMS      int64     `json:"latency_ms"`
+	Proto          string    `json:"proto"`
+	IP             string    `json:"ip,omitempty"`
+	ASN            string    `json:"asn,omitempty"`
+	ASOrg          string    `json:"as_org,omitempty"`
+	Country        string    `json:"country,omitempty"`
+	FinalURL       string    `json:"final_url,omitempty"`
+	Redirects      int       `json:"redirects,omitempty"`
+	RedirectChain  []string  `json:"redirect_chain,omitempty"`
+	Location       string    `json:"location,omitempty"`
+	Size           int64     `json:"size"`           // -1 if unknown
+	ContentLength  int64     `json:"content_length"` // -1 if not sent
+	Server         string    `json:"server,omitempty"`
+	Charset        string    `json:"charset,omitempty"`
+	Cipher         string    `json:"cipher,omitempty"`
+	WeakCipher     bool      `json:"weak_cipher,omitempty"`
+	AltSvc         string    `json:"alt_svc,omitempty"`
+	Cookies        []string  `json:"cookies,omitempty"`
+	CSP            string    `json:"csp,omitempty"`
+	MissingHeaders []string  `json:"missing_headers,omitempty"`
+	JSONIssue      string    `json:"json_issue,omitempty"`
+	Preview        string    `json:"preview,omitempty"`
+}
+
+// toJSON converts r to its -json form
+func toJSON(r scan.Result) jsonResult {
+	out := jsonResult{
+		URL:            r.URL,
+		Status:         r.StatusCode,
+		CheckedAt:      r.CheckedAt,
+		LatencyMS:      r.Latency.Milliseconds(),
+		Proto:          r.Proto,
+		IP:             r.IP,
+		ASN:            r.ASN,
+		ASOrg:          r.ASOrg,
+		Country:        r.Country,
+		FinalURL:       r.FinalURL,
+		Redirects:      r.Redirects,
+		RedirectChain:  r.RedirectChain,
+		Location:       r.Location,
+		Size:           r.Size,
+		ContentLength:  r.ContentLength,
+		Server:         r.Server,
+		Charset:        r.Charset,
+		Cipher:         r.Cipher,
+		WeakCipher:     r.WeakCipher,
+		AltSvc:         r.AltSvc,
+		Cookies:        r.Cookies,
+		CSP:            r.CSP,
+		MissingHeaders: r.MissingHeaders,
+		JSONIssue:      r.JSONIssue,
+		Preview:        r.Preview,
+	}
+	if r.Input != r.URL {
+		out.Input = r.Input
+	}
+	return out
 }
 
-func checkURL(url string, outputChan chan<- statusResult, verbose bool, wg *sync.WaitGroup) {
-	defer wg.Done()
+// csvHeader names the columns of the -csv file, matching csvRecord
+var csvHeader = []string{"url", "status", "latency_ms", "final_url", "content_length", "server"}
 
-	// Add http:// prefix if protocol is missing
-	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
-		url = "http://" + url
+// csvRecord returns the -csv row for r. final_url is empty when the URL
+// did not redirect
+func csvRecord(r scan.Result) []string {
+	return []string{
+		r.URL,
+		strconv.Itoa(r.StatusCode),
+		strconv.FormatInt(r.Latency.Milliseconds(), 10),
+		r.FinalURL,
+		strconv.FormatInt(r.ContentLength, 10),
+		r.Server,
 	}
+}
 
-	// Make HEAD request to check status code
-	resp, err := http.Head(url)
-	if verbose {
-		if err != nil {
-			fmt.Printf("[ERROR] %s: %v\n", url, err)
-			return
+// csvLine encodes record as one line of CSV, quoting fields that contain
+// commas, quotes or newlines
+func csvLine(record []string) string {
+	var buf strings.Builder
+	w := csv.NewWriter(&buf)
+	w.Write(record) // Writing to a strings.Builder can't fail
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// parseCipherList parses a comma-separated list of cipher suite names
+func parseCipherList(list string) map[string]bool {
+	ciphers := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			ciphers[name] = true
+		}
+	}
+	return ciphers
+}
+
+// headerList returns scan.DefaultSecurityHeaders plus the comma-separated extra names,
+// canonicalized and without duplicates
+func headerList(extra string) []string {
+	names := append([]string(nil), scan.DefaultSecurityHeaders...)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		seen[name] = true
+	}
+	for _, name := range strings.Split(extra, ",") {
+		name = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// progressInterval is how often the progress line is redrawn. When other
+// output shares the terminal it is printed as a full line every
+// progressLineInterval instead
+const (
+	progressInterval     = 500 * time.Millisecond
+	progressLineInterval = 5 * time.Second
+)
+
+// progress reports how far the scan has got on stderr
+type progress struct {
+	mu        sync.Mutex
+	out       io.Writer
+	total     int
+	processed int
+	live      int  // URLs that got any HTTP response
+	lines     bool // Print whole lines rather than redrawing one in place
+	start     time.Time
+	stopChan  chan struct{}
+	stopped   chan struct{}
+}
+
+// newProgress starts reporting progress through total URLs to out. Set
+// lines when stdout is on the same terminal and gets written to during
+// the scan, so redraws don't land in the middle of other output
+func newProgress(out io.Writer, total int, lines bool) *progress {
+	p := &progress{
+		out:      out,
+		total:    total,
+		lines:    lines,
+		start:    time.Now(),
+		stopChan: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	interval := progressInterval
+	if lines {
+		interval = progressLineInterval
+	}
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.print(false)
+			case <-p.stopChan:
+				p.print(true)
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// add counts a finished URL
+func (p *progress) add(result scan.Result) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.processed++
+	if result.Err == nil {
+		p.live++
+	}
+	p.mu.Unlock()
+}
+
+func (p *progress) print(final bool) {
+	p.mu.Lock()
+	elapsed := time.Since(p.start).Seconds()
+	rate := 0.0
+	if elapsed > 0 {
+		rate = float64(p.processed) / elapsed
+	}
+	line := fmt.Sprintf("[PROGRESS] %d/%d processed, %d live, %.1f req/s", p.processed, p.total, p.live, rate)
+	p.mu.Unlock()
+	if p.lines {
+		fmt.Fprintln(p.out, line)
+	} else if final {
+		fmt.Fprintf(p.out, "\r%s\x1b[K\n", line) // Leave the last count on screen
+	} else {
+		fmt.Fprintf(p.out, "\r%s\x1b[K", line)
+	}
+}
+
+// stop prints the final count and ends the line, so later output starts
+// on a fresh one. It is safe to call more than once
+func (p *progress) stop() {
+	if p == nil {
+		return
+	}
+	select {
+	case <-p.stopChan:
+	default:
+		close(p.stopChan)
+	}
+	<-p.stopped
+}
+
+// scanStats accumulates the summary printed with -stats
+type scanStats struct {
+	protos    map[string]int
+	asns      map[string]int
+	countries map[string]int
+	ciphers   map[string]int
+	weak      []string          // URLs that negotiated a weak cipher
+	altSvc    map[string]string // Alt-Svc header by host
+	cookies   map[string]int    // Set-Cookie names by number of URLs setting them
+	charsets  map[string]int
+	csp       map[string]bool // Hosts checked with -csp, true if any URL set a policy
+	checked   int             // URLs checked with -security-headers
+	missing   map[string]int  // Security header by number of URLs without it
+	errors    map[string]int  // Failed requests by scan.ErrorCategory
+}
+
+func newScanStats() *scanStats {
+	return &scanStats{
+		protos:    make(map[string]int),
+		asns:      make(map[string]int),
+		countries: make(map[string]int),
+		ciphers:   make(map[string]int),
+		errors:    make(map[string]int),
+		altSvc:    make(map[string]string),
+		cookies:   make(map[string]int),
+		charsets:  make(map[string]int),
+		csp:       make(map[string]bool),
+		missing:   make(map[string]int),
+	}
+}
+
+func (s *scanStats) add(result scan.Result) {
+	s.protos[result.Proto]++
+	if result.Cipher != "" {
+		s.ciphers[result.Cipher]++
+	}
+	if result.WeakCipher {
+		s.weak = append(s.weak, result.URL)
+	}
+	if result.AltSvc != "" {
+		s.altSvc[scan.HostOf(result.URL)] = result.AltSvc
+	}
+	for _, cookie := range result.Cookies {
+		name, _, _ := strings.Cut(cookie, "=")
+		s.cookies[name]++
+	}
+	if result.Charset != "" {
+		s.charsets[result.Charset]++
+	}
+	if result.ASN != "" {
+		s.asns["AS"+result.ASN+" "+result.ASOrg]++
+		s.countries[result.Country]++
+	}
+}
+
+// addCSP records whether result's host sends a Content-Security-Policy.
+// A host counts as covered if any of its URLs set one
+func (s *scanStats) addCSP(result scan.Result) {
+	host := scan.HostOf(result.URL)
+	s.csp[host] = s.csp[host] || result.HasCSP
+}
+
+// printCSP prints how many hosts set a Content-Security-Policy and lists
+// the ones that do not
+func (s *scanStats) printCSP(w io.Writer) {
+	var missing []string
+	for host, set := range s.csp {
+		if !set {
+			missing = append(missing, host)
+		}
+	}
+	sort.Strings(missing)
+	fmt.Fprintf(w, "Content-Security-Policy set by %d of %d hosts\n", len(s.csp)-len(missing), len(s.csp))
+	if len(missing) > 0 {
+		fmt.Fprintf(w, "Hosts without Content-Security-Policy (%d):\n", len(missing))
+		for _, host := range missing {
+			fmt.Fprintf(w, "  %s\n", host)
 		}
-		fmt.Printf("[CHECK] %s: %d\n", url, resp.StatusCode)
 	}
+}
+
+// addHeaders counts which security headers result was missing
+func (s *scanStats) addHeaders(result scan.Result) {
+	s.checked++
+	for _, name := range result.MissingHeaders {
+		s.missing[name]++
+	}
+}
+
+// printHeaders prints, for each checked header, how many URLs sent it
+func (s *scanStats) printHeaders(w io.Writer, names []string) {
+	fmt.Fprintf(w, "Security header coverage (%d URLs):\n", s.checked)
+	for _, name := range names {
+		set := s.checked - s.missing[name]
+		percent := 0.0
+		if s.checked > 0 {
+			percent = 100 * float64(set) / float64(s.checked)
+		}
+		fmt.Fprintf(w, "  %s: %d (%.0f%%)\n", name, set, percent)
+	}
+}
 
+// addError counts a request that got no response
+func (s *scanStats) addError(err error) {
+	s.errors[scan.ErrorCategory(err)]++
+}
+
+func (s *scanStats) print(w io.Writer) {
+	fmt.Fprintln(w, "HTTP versions:")
+	printCounts(w, s.protos)
+	if len(s.errors) > 0 {
+		fmt.Fprintln(w, "Errors:")
+		printCounts(w, s.errors)
+	}
+	if len(s.asns) > 0 {
+		fmt.Fprintln(w, "ASNs:")
+		printCounts(w, s.asns)
+		fmt.Fprintln(w, "Countries:")
+		printCounts(w, s.countries)
+	}
+	if len(s.ciphers) > 0 {
+		fmt.Fprintln(w, "TLS cipher suites:")
+		printCounts(w, s.ciphers)
+	}
+	if len(s.altSvc) > 0 {
+		hosts := make([]string, 0, len(s.altSvc))
+		for host := range s.altSvc {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		fmt.Fprintf(w, "Hosts advertising Alt-Svc (%d):\n", len(hosts))
+		for _, host := range hosts {
+			fmt.Fprintf(w, "  %s: %s\n", host, s.altSvc[host])
+		}
+	}
+	if len(s.cookies) > 0 {
+		fmt.Fprintln(w, "Cookies set:")
+		printCounts(w, s.cookies)
+	}
+	if len(s.charsets) > 0 {
+		fmt.Fprintln(w, "Charsets:")
+		printCounts(w, s.charsets)
+	}
+	if len(s.weak) > 0 {
+		sort.Strings(s.weak)
+		fmt.Fprintf(w, "Weak cipher suites (%d):\n", len(s.weak))
+		for _, url := range s.weak {
+			fmt.Fprintf(w, "  %s\n", url)
+		}
+	}
+}
+
+// printCounts prints one "key: count" line per entry, sorted by key
+func printCounts(w io.Writer, counts map[string]int) {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %s: %d\n", key, counts[key])
+	}
+}
+
+// normalizeURL returns the form used to compare URLs: scheme added,
+// lowercase host and no trailing slash.
+func normalizeURL(rawURL string) string {
+	rawURL = scan.AddScheme(rawURL)
+	u, err := url.Parse(rawURL)
 	if err != nil {
-		return // Silently skip errors if not verbose
+		return strings.TrimRight(rawURL, "/")
 	}
-	defer resp.Body.Close()
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	return u.String()
+}
 
-	outputChan <- statusResult{url: url, statusCode: resp.StatusCode}
+// encodeURL percent-encodes the characters in a URL's path, query and
+// fragment that can't be sent as they are, such as spaces, non-ASCII bytes
+// and stray '%' signs. Existing %XX escapes and reserved characters like
+// '/', '?' and '&' are left untouched, so encoding twice changes nothing.
+func encodeURL(rawURL string) string {
+	start := 0
+	if i := strings.Index(rawURL, "://"); i >= 0 {
+		start = i + 3
+	}
+	// The host is left alone; everything from the first '/', '?' or '#' is encoded
+	end := strings.IndexAny(rawURL[start:], "/?#")
+	if end < 0 {
+		return rawURL
+	}
+	end += start
+
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	b.WriteString(rawURL[:end])
+	rest := rawURL[end:]
+	for i := 0; i < len(rest); i++ {
+		c := rest[i]
+		switch {
+		case c == '%' && i+2 < len(rest) && isHex(rest[i+1]) && isHex(rest[i+2]):
+			b.WriteByte(c) // Already encoded
+		case c <= ' ' || c >= 0x7f || c == '%' || strings.IndexByte(`"<>\^`+"`"+`{|}`, c) >= 0:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&0x0f])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
 }
 
-func processURLs(urls []string, outputChan chan statusResult, requestsPerSecond int, verbose bool, stopChan chan struct{}) {
-	var wg sync.WaitGroup
-	semaphore := make(chan struct{}, requestsPerSecond)
-	ticker := time.NewTicker(time.Second / time.Duration(requestsPerSecond))
-	defer ticker.Stop()
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
 
-	for _, url := range urls {
-		select {
-		case <-stopChan:
-			return // Exit if stop signal received
-		case <-ticker.C:
-			semaphore <- struct{}{} // Acquire semaphore slot
-			wg.Add(1)
-			go func(u string) {
-				defer func() { <-semaphore }() // Release semaphore slot
-				checkURL(u, outputChan, verbose, &wg)
-			}(url)
+// expandSchemes turns each scheme-less URL into an http:// and an https://
+// URL; URLs with an explicit scheme are kept as they are
+func expandSchemes(urls []string) []string {
+	expanded := make([]string, 0, len(urls)*2)
+	for _, u := range urls {
+		if scan.HasScheme(u) {
+			expanded = append(expanded, u)
+			continue
+		}
+		expanded = append(expanded, "http://"+u, "https://"+u)
+	}
+	return expanded
+}
+
+// recordScheme notes which scheme a host answered on. https wins when a host
+// answers on both, whatever order the responses arrived in.
+func recordScheme(schemes map[string]string, rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+	host := strings.ToLower(u.Host)
+	if schemes[host] != "https" {
+		schemes[host] = u.Scheme
+	}
+}
+
+// joinPaths appends each path to base, skipping paths that only differ by
+// leading or trailing slashes, and returns how many duplicates were skipped
+func joinPaths(base string, paths []string) ([]string, int) {
+	seen := make(map[string]bool, len(paths))
+	urls := make([]string, 0, len(paths))
+	for _, path := range paths {
+		key := "/" + strings.Trim(path, "/")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		urls = append(urls, base+"/"+strings.TrimLeft(path, "/"))
+	}
+	return urls, len(paths) - len(urls)
+}
+
+// requestPath returns the path and query of a URL, as saved by
+// -paths-only-output
+func requestPath(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.RequestURI()
+}
+
+// dedupeURLs drops URLs that normalizeURL treats as the same as an earlier
+// one, keeping the first in input order, and returns how many it dropped
+func dedupeURLs(urls []string) ([]string, int) {
+	seen := make(map[string]bool, len(urls))
+	kept := make([]string, 0, len(urls))
+	for _, u := range urls {
+		key := normalizeURL(u)
+		if seen[key] {
+			continue
 		}
+		seen[key] = true
+		kept = append(kept, u)
 	}
-	wg.Wait()
+	return kept, len(urls) - len(kept)
+}
+
+// dropLongURLs removes URLs longer than max bytes and returns how many
+// were removed
+func dropLongURLs(urls []string, max int) ([]string, int) {
+	kept := urls[:0]
+	for _, u := range urls {
+		if len(u) <= max {
+			kept = append(kept, u)
+		}
+	}
+	return kept, len(urls) - len(kept)
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// firstPathSegment returns the first component of a URL's path for use in
+// a file name, or "root" when the path is empty
+func firstPathSegment(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "root"
+	}
+	segment, _, _ := strings.Cut(strings.TrimLeft(u.Path, "/"), "/")
+	segment = strings.Trim(unsafeFileChars.ReplaceAllString(segment, "_"), ".")
+	if segment == "" {
+		return "root"
+	}
+	return segment
+}
+
+// sampleURLs keeps each URL with probability fraction, preserving order
+func sampleURLs(urls []string, fraction float64, rng *rand.Rand) []string {
+	var kept []string
+	for _, u := range urls {
+		if rng.Float64() < fraction {
+			kept = append(kept, u)
+		}
+	}
+	return kept
+}
+
+// capPerHost keeps at most max URLs per host in input order and returns
+// how many were dropped for each host
+func capPerHost(urls []string, max int) ([]string, map[string]int) {
+	seen := make(map[string]int)
+	trimmed := make(map[string]int)
+	var kept []string
+	for _, u := range urls {
+		host := scan.HostOf(u)
+		if seen[host] >= max {
+			trimmed[host]++
+			continue
+		}
+		seen[host]++
+		kept = append(kept, u)
+	}
+	return kept, trimmed
+}
+
+// headerFlag collects repeated -H "Name: value" flags
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	return ""
+}
+
+func (h headerFlag) Set(value string) error {
+	name, val, ok := strings.Cut(value, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("want \"Name: value\", got %q", value)
+	}
+	http.Header(h).Add(name, strings.TrimSpace(val))
+	return nil
+}
+
+// listFlag collects repeated -l flags
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// lineFormat controls how results are written to the text output files
+type lineFormat struct {
+	pathsOnly bool // Write the path and query only (-paths-only-output)
+	stamp     bool // Append the time the URL was checked (-stamp-lines)
+	location  bool // Append where 3xx responses point (-location)
+
+	inputForm bool              // Write URLs as they were typed (-preserve-input-form)
+	typed     map[string]string // Typed form of inputs that were joined or encoded
+}
+
+func (f lineFormat) line(result scan.Result) string {
+	line := result.URL
+	if f.inputForm {
+		line = result.Input
+		if typed, ok := f.typed[line]; ok {
+			line = typed
+		}
+	} else if f.pathsOnly {
+		line = requestPath(result.URL)
+	}
+	if f.location && result.Location != "" {
+		line += "\t" + result.Location
+	}
+	if f.stamp {
+		line += "\t" + result.CheckedAt.Format(time.RFC3339)
+	}
+	return line
+}
+
+func (f lineFormat) lines(results []scan.Result) []string {
+	lines := make([]string, len(results))
+	for i, result := range results {
+		lines[i] = f.line(result)
+	}
+	return lines
+}
+
+// sortByLatency orders results from fastest to slowest response
+func sortByLatency(results []scan.Result) {
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Latency < results[j].Latency })
+}
+
+// makeOutputDir creates the directories in an output prefix such as
+// logs/status, if there are any
+func makeOutputDir(prefix string) error {
+	dir := filepath.Dir(prefix)
+	if dir == "." {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating output directory %s: %v", dir, err)
+	}
+	return nil
 }
 
 func saveURLs(filename string, urls []string) error {
@@ -84,150 +697,1163 @@ func saveURLs(filename string, urls []string) error {
 	return writer.Flush()
 }
 
-func parseStatusRanges(only string) map[int]bool {
+// outputFile is an output file written line by line while the scan runs
+type outputFile struct {
+	mu        sync.Mutex
+	name      string
+	file      *os.File
+	writer    *bufio.Writer
+	autoFlush bool // Flush after every line, for streams read as they are written
+	closed    bool
+}
+
+// writeLine appends line to the file. Lines written after the file was
+// closed by a shutdown are dropped with an error
+func (f *outputFile) writeLine(line string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return fmt.Errorf("error writing to output file %s: %v", f.name, os.ErrClosed)
+	}
+	if _, err := f.writer.WriteString(line + "\n"); err != nil {
+		return fmt.Errorf("error writing to output file %s: %v", f.name, err)
+	}
+	if f.autoFlush {
+		if err := f.writer.Flush(); err != nil {
+			return fmt.Errorf("error writing to output file %s: %v", f.name, err)
+		}
+	}
+	return nil
+}
+
+func (f *outputFile) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	err := f.writer.Flush()
+	if closeErr := f.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error closing output file %s: %v", f.name, err)
+	}
+	return nil
+}
+
+// outputSet tracks the output files that stay open during the scan, so the
+// shutdown path can flush and close every one of them before exiting,
+// whether the scan finished or was interrupted
+type outputSet struct {
+	mu    sync.Mutex
+	files []*outputFile
+}
+
+func (s *outputSet) create(filename string) (*outputFile, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error creating output file %s: %v", filename, err)
+	}
+	return s.add(filename, file), nil
+}
+
+// stream tracks an already open file, such as stdout, that is flushed after
+// every line
+func (s *outputSet) stream(name string, file *os.File) *outputFile {
+	f := s.add(name, file)
+	f.autoFlush = true
+	return f
+}
+
+func (s *outputSet) add(name string, file *os.File) *outputFile {
+	f := &outputFile{name: name, file: file, writer: bufio.NewWriter(file)}
+	s.mu.Lock()
+	s.files = append(s.files, f)
+	s.mu.Unlock()
+	return f
+}
+
+// closeAll flushes and closes every open file, returning the first error.
+// It is safe to call more than once
+func (s *outputSet) closeAll() error {
+	s.mu.Lock()
+	files := s.files
+	s.files = nil
+	s.mu.Unlock()
+	var first error
+	for _, f := range files {
+		if err := f.close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// readURLs reads one URL per line, skipping blank lines. Lines longer than
+// maxLen bytes once trimmed are discarded as they are read, however long
+// they run, and counted in the second return value; 0 means no limit
+func readURLs(r io.Reader, maxLen int) ([]string, int, error) {
+	var urls []string
+	var line []byte
+	var tooLong bool
+	skipped := 0
+	reader := bufio.NewReader(r)
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong {
+			line = append(line, chunk...)
+			// Stop holding a line as soon as it is known to be too long
+			if maxLen > 0 && len(bytes.TrimSpace(line)) > maxLen {
+				tooLong, line = true, line[:0]
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue // The rest of the line is still to come
+		}
+		if err != nil && err != io.EOF {
+			return urls, skipped, err
+		}
+		if tooLong {
+			skipped++
+		} else if url := strings.TrimSpace(string(line)); url != "" {
+			urls = append(urls, url)
+		}
+		if err == io.EOF {
+			return urls, skipped, nil
+		}
+		line, tooLong = line[:0], false
+	}
+}
+
+// readList reads the URLs in an input list opened with openList, with
+// readURLs' limit on line length
+func readList(filename, entry string, maxLen int) ([]string, int, error) {
+	file, err := openList(filename, entry)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error opening file %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	urls, skipped, err := readURLs(file, maxLen)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error reading file %s: %v", filename, err)
+	}
+	return urls, skipped, nil
+}
+
+// isFile reports whether a positional argument names an existing file
+// rather than being a URL to probe
+func isFile(arg string) bool {
+	info, err := os.Stat(arg)
+	return err == nil && !info.IsDir()
+}
+
+// misplacedFlag returns the first positional argument that looks like a
+// flag. flag.Parse stops at the first URL or file, so in
+// `liveurls example.com -v` the -v would otherwise be probed as a URL.
+// Existing files are allowed, so `-- -list.txt` still reads the file
+func misplacedFlag(args []string) (string, bool) {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") && !isFile(arg) {
+			return arg, true
+		}
+	}
+	return "", false
+}
+
+// listReader reads an input list and closes every layer under it
+type listReader struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *listReader) Close() error {
+	var firstErr error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if err := r.closers[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openList opens an input list, transparently decompressing .gz files and
+// reading a single entry from .zip archives. entry selects a named entry in
+// a zip with more than one file.
+func openList(filename, entry string) (io.ReadCloser, error) {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".zip":
+		archive, err := zip.OpenReader(filename)
+		if err != nil {
+			return nil, err
+		}
+		var files []*zip.File
+		for _, f := range archive.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			if entry == "" || f.Name == entry {
+				files = append(files, f)
+			}
+		}
+		if len(files) == 0 {
+			archive.Close()
+			if entry != "" {
+				return nil, fmt.Errorf("entry %s not found in %s", entry, filename)
+			}
+			return nil, fmt.Errorf("no files in %s", filename)
+		}
+		if len(files) > 1 {
+			archive.Close()
+			return nil, fmt.Errorf("%s contains %d files, choose one with -zip-entry", filename, len(files))
+		}
+		rc, err := files[0].Open()
+		if err != nil {
+			archive.Close()
+			return nil, err
+		}
+		return &listReader{Reader: rc, closers: []io.Closer{archive, rc}}, nil
+	case ".gz":
+		file, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return &listReader{Reader: gz, closers: []io.Closer{file, gz}}, nil
+	default:
+		return os.Open(filename)
+	}
+}
+
+// loadBaseline reads previously known URLs into a set keyed by normalized URL
+func loadBaseline(filename string) (map[string]bool, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error opening baseline file %s: %v", filename, err)
+	}
+	defer file.Close()
+
+	urls, _, err := readURLs(file, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error reading baseline file %s: %v", filename, err)
+	}
+	known := make(map[string]bool, len(urls))
+	for _, url := range urls {
+		known[normalizeURL(encodeURL(url))] = true
+	}
+	return known, nil
+}
+
+// inBaseline reports whether r's URL is in the baseline. The input is
+// checked too, since -probe-https and the other scheme options can probe a
+// known scheme-less URL over a scheme the baseline entry didn't get
+func inBaseline(baseline map[string]bool, r scan.Result) bool {
+	return baseline[normalizeURL(r.URL)] || baseline[normalizeURL(r.Input)]
+}
+
+// statusFilter decides which statuses are saved or printed: --only picks
+// statuses first, then --exclude removes some of them again
+type statusFilter struct {
+	only    map[int]bool // nil keeps every status
+	exclude map[int]bool
+}
+
+func (f statusFilter) keep(status int) bool {
+	return (f.only == nil || f.only[status]) && !f.exclude[status]
+}
+
+// parseStatusRanges parses an --only list of ranges like 2xx and exact
+// codes like 404 into the set of statuses they match together. Empty items
+// are skipped; anything else that is neither a range nor a code is an error
+func parseStatusRanges(only string) (map[int]bool, error) {
 	ranges := make(map[int]bool)
 	if only == "" {
-		return nil // No specific ranges, use default behavior
+		return nil, nil // No specific ranges, use default behavior
 	}
 
 	parts := strings.Split(only, ",")
 	for _, part := range parts {
-		part = strings.TrimSpace(part)
-		if len(part) < 3 || !strings.HasSuffix(part, "xx") {
+		part = strings.ToLower(strings.TrimSpace(part))
+		if part == "" {
 			continue
 		}
-		base, err := strconv.Atoi(part[:1])
-		if err != nil {
+		if len(part) == 3 && part[1:] == "xx" && part[0] >= '1' && part[0] <= '5' {
+			base := int(part[0] - '0')
+			for i := 0; i < 100; i++ {
+				ranges[base*100+i] = true
+			}
 			continue
 		}
-		for i := 0; i < 100; i++ {
-			ranges[base*100+i] = true
+		code, err := strconv.Atoi(part)
+		if err != nil || len(part) != 3 || code < 100 || code > 599 {
+			return nil, fmt.Errorf("invalid status %q: want a range like 2xx or a code from 100 to 599", part)
 		}
+		ranges[code] = true
 	}
-	return ranges
+	return ranges, nil
+}
+
+// checkRate validates -d, -c, -burst and -strict-rate together and returns
+// how many requests may be in flight at once. -d 0 lifts the rate limit,
+// so -c must then say how much may run at once
+func checkRate(rate, concurrency, burst int, strict bool) (int, error) {
+	if rate < 0 {
+		return 0, fmt.Errorf("Invalid -d %d: must be 0 (no rate limit) or more requests per second", rate)
+	}
+	if concurrency < 0 {
+		return 0, fmt.Errorf("Invalid -c %d: must be 0 or more", concurrency)
+	}
+	if concurrency == 0 {
+		concurrency = rate // Keep the old behaviour of one slot per request per second
+	}
+	if concurrency == 0 {
+		return 0, errors.New("-d 0 removes the rate limit; set -c to cap how many requests run at once")
+	}
+	if strict && rate == 0 {
+		return 0, errors.New("-strict-rate needs a rate: set -d to 1 or more")
+	}
+	if burst < 1 {
+		return 0, fmt.Errorf("Invalid -burst %d: must be 1 or more", burst)
+	}
+	if strict && burst > 1 {
+		return 0, errors.New("-strict-rate allows no bursts; drop it or -burst")
+	}
+	return concurrency, nil
+}
+
+// Exit codes for failed runs, so automation can tell "wrong status" apart
+// from "unreachable"
+const (
+	exitExpectFailed = 3   // A URL missed its -expect status
+	exitErrors       = 4   // A request got no response at all (-error-exit)
+	exitEmpty        = 5   // No URL matched --only/--exclude (-fail-if-empty)
+	exitInterrupted  = 130 // A second Ctrl+C cut the run short
+)
+
+const usage = "Usage: liveurls [-l <file>]... [-o <output>] [-d <rate>] [-c <concurrency>] [-v] [--only <ranges>] [url|file]...\n" +
+	"  -d sets how many requests start per second, -c how many may be in flight at once (default: same as -d).\n" +
+	"  A -c above -d lets slow hosts answer without holding up the rate, which -d still caps."
+
+// isTerminal reports whether f is an interactive terminal rather than a
+// pipe or file
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
 }
 
 func main() {
 	// Define command-line flags
-	listPtr := flag.String("l", "", "File containing list of URLs")
+	var lists listFlag
+	flag.Var(&lists, "l", "File containing list of URLs (repeatable)")
 	outputPtr := flag.String("o", "status", "Base name for output files")
 	ratePtr := flag.Int("d", 10, "Number of requests per second")
+	concurrencyPtr := flag.Int("c", 0, "Maximum number of requests in flight at once (0 = same as -d)")
 	verbosePtr := flag.Bool("v", false, "Enable verbose output")
-	onlyPtr := flag.String("only", "", "Comma-separated status code ranges (e.g., 2xx,3xx)")
+	quietPtr := flag.Bool("quiet", false, "Don't show the progress line on stderr")
+	excludePtr := flag.String("exclude", "", "Comma-separated status code ranges and exact codes not to save (e.g., 404,5xx)")
+	onlyPtr := flag.String("only", "", "Comma-separated status code ranges and exact codes (e.g., 2xx,301,404)")
+	baselinePtr := flag.String("baseline", "", "File of previously known URLs; only new URLs are reported")
+	sortLatencyPtr := flag.Bool("sort-latency", false, "Order the URLs in each saved file from fastest to slowest response")
+	keepDupesPtr := flag.Bool("keep-dupes", false, "Probe every input line, even URLs listed more than once")
+	csvPtr := flag.String("csv", "", "Write every result to this CSV file (url,status,latency_ms,final_url,content_length,server) instead of the per-status files")
+	livePtr := flag.Bool("live", false, "Print every URL that got any HTTP response to stdout, one per line, instead of saving files")
+	statusColPtr := flag.Bool("status", false, "With -live, print \"url status\" on each line")
+	jsonPtr := flag.Bool("json", false, "Print one JSON object per result to stdout as results arrive, instead of saving files")
+	byPathPtr := flag.Bool("by-path", false, "Save results to one file per first path segment instead of per status range")
+	splitErrorsPtr := flag.Bool("split-errors", false, "Save failed URLs to one file per error category (dns, timeout, refused, reset, tls, other)")
+	failIfEmptyPtr := flag.Bool("fail-if-empty", false, "Fail (exit code 5) if no URL matched --only/--exclude; on by default with --only")
+	errorExitPtr := flag.Bool("error-exit", false, "Fail (exit code 4) if any URL got no response (DNS, connect, TLS or timeout errors)")
+	expectPtr := flag.Int("expect", 0, "Fail (exit code 3) if any URL does not return this status code")
+	statsPtr := flag.Bool("stats", false, "Print a summary of the scan (HTTP versions, TLS ciphers, ASNs)")
+	samplePtr := flag.Float64("sample", 0, "Probe a random fraction of the URLs, e.g. 0.1 for about 10%")
+	seedPtr := flag.Int64("seed", 0, "Random seed for -sample, for reproducible samples (0 = random)")
+	perHostPtr := flag.Int("max-urls-per-host", 0, "Probe at most N URLs per host (0 = no limit)")
+	noDrainPtr := flag.Bool("no-drain", false, "Close response bodies without draining them (disables connection reuse)")
+	racePtr := flag.Bool("race-schemes", false, "Probe scheme-less URLs over http:// and https:// at once and keep the first answer")
+	probeHTTPSPtr := flag.Bool("probe-https", false, "Probe scheme-less URLs over https:// first, falling back to http:// if that fails")
+	otherSchemePtr := flag.Bool("retry-other-scheme", false, "Retry a request that fails with a connection or TLS error over the other scheme (https <-> http)")
+	bothPtr := flag.Bool("both", false, "Probe scheme-less URLs over both http:// and https:// and save a host/scheme map")
+	globalThrottlePtr := flag.Bool("global-throttle-on-429", false, "Pause all hosts, not just the sender, after a 429 or 503")
+	expectJSONPtr := flag.Bool("expect-json", false, "Fetch bodies with GET and flag responses that are not valid JSON")
+	expectKeyPtr := flag.String("expect-key", "", "Top-level key the JSON body must contain (implies -expect-json)")
+	cookiesPtr := flag.Bool("cookies", false, "Record the names of cookies set by each response")
+	cookieValuesPtr := flag.Bool("cookie-values", false, "Record cookie values as well as names (implies -cookies)")
+	cspPtr := flag.Bool("csp", false, "Check which hosts set a Content-Security-Policy header")
+	cspValuePtr := flag.Bool("csp-value", false, "Save the full Content-Security-Policy of each URL (implies -csp)")
+	minSizePtr := flag.Int64("min-size", 0, "Only save URLs whose body is at least this many bytes")
+	maxSizePtr := flag.Int64("max-size", 0, "Only save URLs whose body is at most this many bytes (0 = no limit)")
+	securityHeadersPtr := flag.Bool("security-headers", false, "Report which standard security headers (HSTS, CSP, X-Frame-Options, ...) each URL is missing")
+	checkHeadersPtr := flag.String("check-headers", "", "Comma-separated extra header names to check for (implies -security-headers)")
+	strictRatePtr := flag.Bool("strict-rate", false, "Never start requests faster than -d, not even in short bursts (same as -burst 1)")
+	burstPtr := flag.Int("burst", 1, "Requests that may start back to back, above the -d rate, after a quiet spell")
+	previewPtr := flag.Int("preview", 0, "Fetch bodies with GET and show the first N bytes in verbose output")
+	charsetPtr := flag.Bool("charset", false, "Record the charset each response declares in its Content-Type header")
+	metaCharsetPtr := flag.Bool("meta-charset", false, "Fetch bodies with GET and also read <meta charset> from HTML pages (implies -charset)")
+	followMetaPtr := flag.Bool("follow-meta", false, "Fetch bodies with GET and follow <meta http-equiv=\"refresh\"> redirects")
+	geoDBPtr := flag.String("geodb", "", "Comma-separated offline databases (MaxMind .mmdb such as GeoLite2-ASN and GeoLite2-Country, or iptoasn.com TSV) used to annotate results with ASN and country")
+	baseURLPtr := flag.String("base-url", "", "Treat each input line as a path to probe under this base URL")
+	stampPtr := flag.Bool("stamp-lines", false, "Write each saved URL as <url><TAB><RFC3339 time it was checked>")
+	pathsOnlyPtr := flag.Bool("paths-only-output", false, "Save only the path and query of each URL, not the full URL")
+	preserveInputPtr := flag.Bool("preserve-input-form", false, "Save URLs exactly as they appeared in the input, without an added scheme")
+	cmdPtr := flag.String("cmd", "", "Shell command whose output is used as the URL list (e.g. \"subfinder -d example.com\")")
+	maxURLLenPtr := flag.Int("max-url-len", 8192, "Skip URLs longer than this many bytes (0 = no limit)")
+	cacheDNSPtr := flag.Bool("cache-dns", false, "Resolve each host once before scanning and reuse the addresses for the whole run")
+	headers := headerFlag{}
+	flag.Var(headers, "H", "Extra request header as \"Name: value\" (repeatable)")
+	uaPtr := flag.String("ua", "liveurls/1.0", "User-Agent to send (a -H User-Agent header takes precedence)")
+	methodPtr := flag.String("method", "HEAD", "Request method to probe with: HEAD (falls back to GET when unsupported) or GET")
+	timeoutPtr := flag.Int("timeout", 10, "Seconds to wait for each URL before giving up (0 = no timeout)")
+	retriesPtr := flag.Int("retries", 0, "Retry URLs that fail or get 429/503 this many times, with exponential backoff")
+	maxHeaderPtr := flag.Int64("max-header-bytes", 1<<20, "Maximum size of response headers in bytes")
+	maxRedirectsPtr := flag.Int("max-redirects", 10, "Follow at most N redirects, then record the 3xx response (0 = don't follow)")
+	proxyPtr := flag.String("proxy", "", "Send requests through this proxy, e.g. http://127.0.0.1:8080 or socks5://127.0.0.1:9050")
+	insecurePtr := flag.Bool("insecure", false, "Don't verify TLS certificates, for hosts with self-signed or expired ones")
+	noRedirectPtr := flag.Bool("no-redirect", false, "Don't follow redirects; record each 3xx response as is (same as -max-redirects 0)")
+	locationPtr := flag.Bool("location", false, "Record where 3xx responses point and save it as <url><TAB><location>")
+	hostDelayPtr := flag.Duration("host-delay", 0, "Minimum time between requests to the same host (e.g. 500ms)")
+	maxThrottlePtr := flag.Duration("max-throttle", 30*time.Second, "Longest pause a 429/503 Retry-After can cause (0 = no limit)")
+	weakCiphersPtr := flag.String("weak-ciphers", "", "Comma-separated TLS cipher suite names to offer and flag as weak (default: flag Go's insecure suites if negotiated, offer none)")
+	stdinPtr := flag.Bool("stdin", false, "Read URLs from stdin even when it is a terminal")
+	zipEntryPtr := flag.String("zip-entry", "", "Entry to read when -l is a zip archive with several files")
 	flag.Parse()
+	if arg, ok := misplacedFlag(flag.Args()); ok {
+		fmt.Fprintf(os.Stderr, "Misplaced flag %s: flags must come before URLs/files\n", arg)
+		os.Exit(2)
+	}
 
 	var urls []string
+	var longLines int // Input lines over -max-url-len, dropped while reading
+	maxLen := *maxURLLenPtr
+	if maxLen < 0 {
+		maxLen = 0
+	}
 
-	// Check if reading from file (-l flag)
-	if *listPtr != "" {
-		file, err := os.Open(*listPtr)
+	// Read every file given with -l, in order
+	for _, list := range lists {
+		listURLs, skipped, err := readList(list, *zipEntryPtr, maxLen)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error opening file: %v\n", err)
+			fmt.Fprintf(os.Stderr, "%v\n", err)
 			os.Exit(1)
 		}
-		defer file.Close()
+		urls = append(urls, listURLs...)
+		longLines += skipped
+	}
 
-		scanner := bufio.NewScanner(file)
-		for scanner.Scan() {
-			url := strings.TrimSpace(scanner.Text())
-			if url != "" {
-				urls = append(urls, url)
-			}
+	// Read the output of a discovery command (-cmd flag)
+	if *cmdPtr != "" {
+		cmd := exec.Command("sh", "-c", *cmdPtr)
+		cmd.Stderr = os.Stderr
+		output, err := cmd.Output()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error running command %q: %v\n", *cmdPtr, err)
+			os.Exit(1)
 		}
-		if err := scanner.Err(); err != nil {
-			fmt.Fprintf(os.Stderr, "Error reading file: %v\n", err)
+		cmdURLs, skipped, err := readURLs(bytes.NewReader(output), maxLen)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error reading command output: %v\n", err)
 			os.Exit(1)
 		}
-	} else {
-		// Read from stdin if no file specified
-		scanner := bufio.NewScanner(os.Stdin)
-		for scanner.Scan() {
-			url := strings.TrimSpace(scanner.Text())
-			if url != "" {
-				urls = append(urls, url)
+		urls = append(urls, cmdURLs...)
+		longLines += skipped
+	}
+
+	// Positional arguments are list files if they exist, URLs otherwise
+	for _, arg := range flag.Args() {
+		if !isFile(arg) {
+			if arg = strings.TrimSpace(arg); arg != "" {
+				urls = append(urls, arg)
 			}
+			continue
+		}
+		argURLs, skipped, err := readList(arg, *zipEntryPtr, maxLen)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
 		}
-		if err := scanner.Err(); err != nil {
+		urls = append(urls, argURLs...)
+		longLines += skipped
+	}
+
+	// Fall back to stdin when no other source was given, or add it with -stdin
+	haveSource := len(lists) > 0 || *cmdPtr != "" || flag.NArg() > 0
+	if !haveSource && !*stdinPtr && isTerminal(os.Stdin) {
+		// Nothing is piped in, so don't sit waiting for input that never comes
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	if !haveSource || *stdinPtr {
+		stdinURLs, skipped, err := readURLs(os.Stdin, maxLen)
+		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error reading stdin: %v\n", err)
 			os.Exit(1)
 		}
+		urls = append(urls, stdinURLs...)
+		longLines += skipped
+	}
+
+	// Load previously known URLs (-baseline flag)
+	var baseline map[string]bool
+	if *baselinePtr != "" {
+		var err error
+		baseline, err = loadBaseline(*baselinePtr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
 	}
 
 	if len(urls) == 0 {
-		fmt.Println("No URLs provided. Usage: liveurls [-l <file>] [-o <output>] [-d <rate>] [-v] [--only <ranges>]")
+		fmt.Println("No URLs provided. " + usage)
+		os.Exit(1)
+	}
+
+	// Create the output directory up front so a finished scan can always be saved
+	if err := makeOutputDir(*outputPtr); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	// Remember how inputs were typed so they can be saved that way (-preserve-input-form flag)
+	var typed map[string]string
+	if *preserveInputPtr {
+		typed = make(map[string]string)
+	}
+
+	// Treat each input line as a path under a fixed base URL (-base-url flag)
+	if *baseURLPtr != "" {
+		base, err := url.Parse(*baseURLPtr)
+		if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+			fmt.Fprintf(os.Stderr, "Invalid -base-url %q: must be an absolute http:// or https:// URL\n", *baseURLPtr)
+			os.Exit(1)
+		}
+		prefix := strings.TrimRight(*baseURLPtr, "/")
+		if typed != nil {
+			for _, path := range urls {
+				typed[prefix+"/"+strings.TrimLeft(path, "/")] = path
+			}
+		}
+		var dupes int
+		urls, dupes = joinPaths(prefix, urls)
+		if *verbosePtr && dupes > 0 {
+			fmt.Printf("[DEDUP] removed %d duplicate paths\n", dupes)
+		}
+	}
+
+	// Percent-encode spaces and other characters that can't go on the wire as-is
+	for i, u := range urls {
+		urls[i] = encodeURL(u)
+		if typed != nil && urls[i] != u {
+			if path, ok := typed[u]; ok {
+				u = path
+			}
+			typed[urls[i]] = u
+		}
+	}
+
+	// Probe each URL once, however often it was listed (-keep-dupes flag)
+	if !*keepDupesPtr {
+		var dupes int
+		urls, dupes = dedupeURLs(urls)
+		if *verbosePtr && dupes > 0 {
+			fmt.Printf("[DEDUP] removed %d duplicate URLs\n", dupes)
+		}
+	}
+
+	// Skip garbage lines that are far too long to be real URLs (-max-url-len flag)
+	if *maxURLLenPtr > 0 {
+		var skipped int
+		urls, skipped = dropLongURLs(urls, *maxURLLenPtr)
+		// Lines already dropped while reading count too
+		if skipped += longLines; skipped > 0 {
+			fmt.Fprintf(os.Stderr, "Skipped %d URLs longer than %d bytes\n", skipped, *maxURLLenPtr)
+		}
+	}
+
+	// Probe only a random sample of the list (-sample flag)
+	if *samplePtr != 0 {
+		if *samplePtr < 0 || *samplePtr > 1 {
+			fmt.Fprintf(os.Stderr, "Invalid -sample %v: must be between 0 and 1\n", *samplePtr)
+			os.Exit(1)
+		}
+		seed := *seedPtr
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		total := len(urls)
+		urls = sampleURLs(urls, *samplePtr, rand.New(rand.NewSource(seed)))
+		fmt.Fprintf(os.Stderr, "Sampled %d of %d URLs (seed %d)\n", len(urls), total, seed)
+	}
+
+	// Limit how many URLs are probed per host (-max-urls-per-host flag)
+	if *perHostPtr > 0 {
+		var trimmed map[string]int
+		urls, trimmed = capPerHost(urls, *perHostPtr)
+		if *verbosePtr {
+			hosts := make([]string, 0, len(trimmed))
+			for host := range trimmed {
+				hosts = append(hosts, host)
+			}
+			sort.Strings(hosts)
+			for _, host := range hosts {
+				fmt.Printf("[TRIM] %s: skipped %d URLs over the per-host limit\n", host, trimmed[host])
+			}
+		}
+	}
+
+	concurrency, err := checkRate(*ratePtr, *concurrencyPtr, *burstPtr, *strictRatePtr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *timeoutPtr < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -timeout %d: must be 0 or more seconds\n", *timeoutPtr)
+		os.Exit(1)
+	}
+	var proxy *url.URL
+	if *proxyPtr != "" {
+		var err error
+		proxy, err = url.Parse(*proxyPtr)
+		if err != nil || proxy.Host == "" || (proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5" && proxy.Scheme != "socks5h") {
+			fmt.Fprintf(os.Stderr, "Invalid -proxy %q: must be an http://, https:// or socks5:// URL with a host, e.g. http://127.0.0.1:8080\n", *proxyPtr)
+			os.Exit(1)
+		}
+	}
+	if *livePtr && *jsonPtr {
+		fmt.Fprintln(os.Stderr, "-live and -json both print results to stdout; use one of them")
+		os.Exit(1)
+	}
+	if *statusColPtr && !*livePtr {
+		fmt.Fprintln(os.Stderr, "-status adds a column to -live output; set -live too")
+		os.Exit(1)
+	}
+	if *maxThrottlePtr < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -max-throttle %v: must be 0 or more\n", *maxThrottlePtr)
+		os.Exit(1)
+	}
+	if *retriesPtr < 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -retries %d: must be 0 or more\n", *retriesPtr)
 		os.Exit(1)
 	}
 
+	if *maxHeaderPtr <= 0 {
+		fmt.Fprintf(os.Stderr, "Invalid -max-header-bytes %d: must be positive\n", *maxHeaderPtr)
+		os.Exit(1)
+	}
+
+	method := strings.ToUpper(*methodPtr)
+	if method != http.MethodHead && method != http.MethodGet {
+		fmt.Fprintf(os.Stderr, "Invalid -method %q: must be HEAD or GET\n", *methodPtr)
+		os.Exit(1)
+	}
+
+	header := http.Header(headers)
+	if header.Get("User-Agent") == "" && *uaPtr != "" {
+		header.Set("User-Agent", *uaPtr)
+	}
+
+	cfg := scan.New()
+	cfg.Rate = *ratePtr
+	cfg.Burst = *burstPtr
+	cfg.Concurrency = concurrency
+	cfg.Timeout = time.Duration(*timeoutPtr) * time.Second
+	cfg.Header = header
+	cfg.Method = method
+	cfg.Retries = *retriesPtr
+
+	cfg.MaxRedirects = *maxRedirectsPtr
+	if *noRedirectPtr {
+		cfg.MaxRedirects = 0
+	}
+	cfg.MaxHeaderBytes = *maxHeaderPtr
+	cfg.Insecure = *insecurePtr
+	cfg.Proxy = proxy
+	cfg.CacheDNS = *cacheDNSPtr
+	cfg.NoDrain = *noDrainPtr
+	cfg.GlobalThrottle = *globalThrottlePtr
+	cfg.MaxThrottle = *maxThrottlePtr
+	cfg.HostDelay = *hostDelayPtr
+
+	cfg.ExpectJSON = *expectJSONPtr || *expectKeyPtr != ""
+	cfg.ExpectKey = *expectKeyPtr
+	cfg.FollowMeta = *followMetaPtr
+
+	cfg.Location = *locationPtr
+	cfg.Charset = *charsetPtr || *metaCharsetPtr
+	cfg.MetaCharset = *metaCharsetPtr
+
+	cfg.PreviewBytes = *previewPtr
+
+	cfg.Cookies = *cookiesPtr || *cookieValuesPtr
+	cfg.CookieValues = *cookieValuesPtr
+
+	cfg.CSP = *cspPtr || *cspValuePtr
+	cfg.CSPValues = *cspValuePtr
+
+	cfg.MinSize = *minSizePtr
+	cfg.MaxSize = *maxSizePtr
+
+	cfg.RetryOtherScheme = *otherSchemePtr
+	cfg.RaceSchemes = *racePtr
+	cfg.ProbeHTTPS = *probeHTTPSPtr
+
+	if *verbosePtr {
+		cfg.Log = os.Stdout
+	}
+
+	if *weakCiphersPtr != "" {
+		// Auditing for weak suites means offering them, so hosts that accept
+		// nothing better connect and get flagged instead of failing
+		cfg.WeakCiphers = parseCipherList(*weakCiphersPtr)
+		cfg.OfferWeakCiphers = true
+	}
+	if *securityHeadersPtr || *checkHeadersPtr != "" {
+		cfg.SecurityHeaders = headerList(*checkHeadersPtr)
+	}
+
+	if cfg.PreviewBytes < 0 || cfg.PreviewBytes > scan.MaxBodyBytes {
+		fmt.Fprintf(os.Stderr, "Invalid -preview %d: must be between 0 and %d\n", cfg.PreviewBytes, scan.MaxBodyBytes)
+		os.Exit(1)
+	}
+	if cfg.MinSize < 0 || cfg.MaxSize < 0 || (cfg.MaxSize > 0 && cfg.MaxSize < cfg.MinSize) {
+		fmt.Fprintf(os.Stderr, "Invalid size range -min-size %d -max-size %d\n", cfg.MinSize, cfg.MaxSize)
+		os.Exit(1)
+	}
+
+	// Load the IP enrichment databases (-geodb flag), e.g. an ASN and a country one
+	if *geoDBPtr != "" {
+		var files []string
+		for _, name := range strings.Split(*geoDBPtr, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				files = append(files, name)
+			}
+		}
+		geo, err := scan.LoadGeoDB(files...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		cfg.Geo = geo
+	}
+
+	// Probe both schemes for scheme-less URLs (-both flag)
+	if *bothPtr {
+		urls = expandSchemes(urls)
+	}
+
 	// Parse status code ranges
-	statusRanges := parseStatusRanges(*onlyPtr)
+	statusRanges, err := parseStatusRanges(*onlyPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --only %q: %v\n", *onlyPtr, err)
+		os.Exit(1)
+	}
+	excluded, err := parseStatusRanges(*excludePtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid --exclude %q: %v\n", *excludePtr, err)
+		os.Exit(1)
+	}
+	filter := statusFilter{only: statusRanges, exclude: excluded}
 
 	// Channels for URLs and shutdown
-	outputChan := make(chan statusResult, len(urls))
-	stopChan := make(chan struct{})
-	results := make(map[int][]string) // Map of status code to URLs
+	results := make(map[int][]scan.Result) // Map of status code to results
+	stats := newScanStats()
+	schemes := make(map[string]string)         // Map of host to the scheme it answered on
+	var badJSON []scan.Result                  // Results that failed -expect-json
+	var mismatches []scan.Result               // Results that failed -expect
+	failures := make(map[string][]scan.Result) // Map of error category to failed requests
+	var policies []string                      // "url<TAB>policy" lines for -csp-value
+	var missingHeaders []string                // "url<TAB>headers" lines for -security-headers
 	var mu sync.Mutex
 
-	// Handle Ctrl+C for graceful shutdown
+	// Files written during the scan (-json, -csv and the rest) are flushed
+	// and closed by exit, the one way main ends once the scan has started:
+	// on completion, on an error, on interrupt and on a second Ctrl+C
+	outputs := &outputSet{}
+	exit := func(code int) {
+		if err := outputs.closeAll(); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			if code == 0 {
+				code = 1
+			}
+		}
+		os.Exit(code)
+	}
+
+	// Stream results to stdout instead of saving them (-json flag)
+	var jsonOut *outputFile
+	if *jsonPtr {
+		jsonOut = outputs.stream("stdout", os.Stdout)
+	}
+
+	// Print responding URLs to stdout as they arrive (-live flag)
+	var liveOut *outputFile
+	if *livePtr {
+		liveOut = outputs.stream("stdout", os.Stdout)
+	}
+
+	// Write results to a single CSV file as they arrive (-csv flag)
+	var csvOut *outputFile
+	csvRows := 0
+	if *csvPtr != "" {
+		var err error
+		if csvOut, err = outputs.create(*csvPtr); err == nil {
+			err = csvOut.writeLine(csvLine(csvHeader))
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			exit(1)
+		}
+	}
+
+	// Handle Ctrl+C for graceful shutdown: cancelling ctx stops new requests
+	// and cancels the ones in flight
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
-	// Process URLs in a goroutine
-	go func() {
-		processURLs(urls, outputChan, *ratePtr, *verbosePtr, stopChan)
-		close(outputChan)
-	}()
+	// Start the scan; it runs in the background and sends results to outputChan
+	outputChan, err := cfg.Scan(ctx, urls)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		exit(1)
+	}
+
+	// Show progress on stderr when it is a terminal (-quiet flag turns it off)
+	var prog *progress
+	if !*quietPtr && isTerminal(os.Stderr) {
+		prog = newProgress(os.Stderr, len(urls), isTerminal(os.Stdout) && (*verbosePtr || *jsonPtr || *livePtr))
+	}
 
-	// Collect results
+	// Collect results. This is the only reader of outputChan, and done is
+	// closed once every result has been collected
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		for result := range outputChan {
+			prog.add(result)
+			if inBaseline(baseline, result) {
+				continue // Already known, only report new URLs
+			}
 			mu.Lock()
-			results[result.statusCode] = append(results[result.statusCode], result.url)
+			if *expectPtr != 0 && (result.Err != nil || result.StatusCode != *expectPtr) {
+				mismatches = append(mismatches, result)
+			}
+			if result.Err != nil {
+				stats.addError(result.Err)
+				category := scan.ErrorCategory(result.Err)
+				failures[category] = append(failures[category], result)
+				mu.Unlock()
+				continue
+			}
+			if !cfg.SizeOK(result) {
+				mu.Unlock()
+				continue // Outside -min-size/-max-size
+			}
+			results[result.StatusCode] = append(results[result.StatusCode], result)
+			if jsonOut != nil && filter.keep(result.StatusCode) {
+				line, err := json.Marshal(toJSON(result))
+				if err == nil {
+					err = jsonOut.writeLine(string(line))
+				}
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+				}
+			}
+			if liveOut != nil && filter.keep(result.StatusCode) {
+				line := result.URL
+				if *statusColPtr {
+					line += " " + strconv.Itoa(result.StatusCode)
+				}
+				if err := liveOut.writeLine(line); err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+				}
+			}
+			if csvOut != nil && filter.keep(result.StatusCode) {
+				if err := csvOut.writeLine(csvLine(csvRecord(result))); err != nil {
+					fmt.Fprintf(os.Stderr, "%v\n", err)
+				} else {
+					csvRows++
+				}
+			}
+			stats.add(result)
+			recordScheme(schemes, result.URL)
+			if result.JSONIssue != "" {
+				badJSON = append(badJSON, result)
+			}
+			if cfg.CSP {
+				stats.addCSP(result)
+			}
+			if result.CSP != "" {
+				policies = append(policies, result.URL+"\t"+result.CSP)
+			}
+			if cfg.SecurityHeaders != nil {
+				stats.addHeaders(result)
+				if len(result.MissingHeaders) > 0 {
+					missingHeaders = append(missingHeaders, result.URL+"\t"+strings.Join(result.MissingHeaders, ", "))
+				}
+			}
 			mu.Unlock()
 		}
 	}()
 
+	// Summaries go to stderr when stdout carries -json or -live results
+	var report io.Writer = os.Stdout
+	if *jsonPtr || *livePtr {
+		report = os.Stderr
+	}
+
 	// Wait for either completion or interrupt
 	select {
 	case <-sigChan:
-		close(stopChan)
-		fmt.Println("\nReceived interrupt, saving current progress...")
-	case <-func() chan struct{} {
-		done := make(chan struct{})
+		cancel()
+		prog.stop()
+		fmt.Fprintln(report, "\nReceived interrupt, saving current progress... (Ctrl+C again to quit now)")
 		go func() {
-			for range outputChan {
-			}
-			close(done)
+			// Don't wait for slow requests or saving if asked twice, but
+			// still flush what the streams hold
+			<-sigChan
+			fmt.Fprintln(os.Stderr, "\nInterrupted again, exiting")
+			exit(exitInterrupted)
 		}()
-		return done
-	}():
+		<-done // In-flight requests are cancelled, so this is quick
+	case <-done:
+		prog.stop()
 	}
 
-	// Save results based on --only or default behavior
-	if statusRanges != nil {
+	format := lineFormat{pathsOnly: *pathsOnlyPtr, stamp: *stampPtr, inputForm: *preserveInputPtr, typed: typed, location: *locationPtr}
+
+	// Save results based on -json, -live, -csv, --by-path, --only or default behavior
+	if *jsonPtr || *livePtr {
+		// Results were already streamed to stdout, nothing is saved
+		if csvOut != nil {
+			fmt.Fprintf(report, "Wrote %d results to %s\n", csvRows, *csvPtr)
+		}
+	} else if csvOut != nil {
+		// Results were already written to the CSV file
+		fmt.Printf("Wrote %d results to %s (rate: %d req/s)\n", csvRows, *csvPtr, *ratePtr)
+	} else if *byPathPtr {
+		// Group URLs by first path segment, still honouring --only
+		groups := make(map[string][]scan.Result)
+		for status, statusResults := range results {
+			if !filter.keep(status) {
+				continue
+			}
+			for _, result := range statusResults {
+				segment := firstPathSegment(result.URL)
+				groups[segment] = append(groups[segment], result)
+			}
+		}
+		for segment, group := range groups {
+			if *sortLatencyPtr {
+				sortByLatency(group)
+			}
+			pathFile := fmt.Sprintf("%s_path_%s.txt", *outputPtr, segment)
+			if err := saveURLs(pathFile, format.lines(group)); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				exit(1)
+			}
+			fmt.Printf("Found %d URLs under %s. Saved to %s (rate: %d req/s)\n", len(group), segment, pathFile, *ratePtr)
+		}
+		if len(groups) == 0 {
+			fmt.Printf("No URLs processed successfully (rate: %d req/s)\n", *ratePtr)
+		}
+	} else if filter.only != nil {
 		// Specific ranges specified
-		var filteredURLs []string
-		for status, urls := range results {
-			if statusRanges[status] {
-				filteredURLs = append(filteredURLs, urls...)
+		var matched []scan.Result
+		for status, statusResults := range results {
+			if filter.keep(status) {
+				matched = append(matched, statusResults...)
 			}
 		}
+		if *sortLatencyPtr {
+			sortByLatency(matched)
+		}
+		filteredURLs := format.lines(matched)
 		if err := saveURLs(*outputPtr+".txt", filteredURLs); err != nil {
 			fmt.Fprintf(os.Stderr, "%v\n", err)
-			os.Exit(1)
+			exit(1)
 		}
 		fmt.Printf("Found %d URLs matching %s. Results saved to %s.txt (rate: %d req/s)\n", len(filteredURLs), *onlyPtr, *outputPtr, *ratePtr)
 	} else {
-		// Default behavior: save to separate files by status code range
-		for status, urls := range results {
-			rangeFile := fmt.Sprintf("%s_%dxx.txt", *outputPtr, status/100)
+		// Default behavior: save to separate files by status code range.
+		// Group first so 200 and 204 end up in the same _2xx file
+		ranges := make(map[int][]scan.Result)
+		for status, statusResults := range results {
+			if filter.keep(status) {
+				ranges[status/100] = append(ranges[status/100], statusResults...)
+			}
+		}
+		for class, classResults := range ranges {
+			if *sortLatencyPtr {
+				sortByLatency(classResults)
+			}
+			rangeFile := fmt.Sprintf("%s_%dxx.txt", *outputPtr, class)
+			urls := format.lines(classResults)
 			if err := saveURLs(rangeFile, urls); err != nil {
 				fmt.Fprintf(os.Stderr, "%v\n", err)
-				os.Exit(1)
+				exit(1)
 			}
-			fmt.Printf("Found %d URLs with %dxx status. Saved to %s (rate: %d req/s)\n", len(urls), status/100, rangeFile, *ratePtr)
+			fmt.Printf("Found %d URLs with %dxx status. Saved to %s (rate: %d req/s)\n", len(urls), class, rangeFile, *ratePtr)
 		}
-		if len(results) == 0 {
+		if len(ranges) == 0 {
 			fmt.Printf("No URLs processed successfully (rate: %d req/s)\n", *ratePtr)
 		}
 	}
+
+	// Save failed requests grouped by reason (-split-errors flag)
+	if *splitErrorsPtr && !*jsonPtr {
+		mu.Lock()
+		for category, failed := range failures {
+			errorFile := fmt.Sprintf("%s_err_%s.txt", *outputPtr, category)
+			if err := saveURLs(errorFile, format.lines(failed)); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				exit(1)
+			}
+			fmt.Fprintf(report, "Found %d URLs failing with %s errors. Saved to %s\n", len(failed), category, errorFile)
+		}
+		mu.Unlock()
+	}
+
+	// Save responses that failed the JSON check (-expect-json flag)
+	if cfg.ExpectJSON && !*jsonPtr {
+		mu.Lock()
+		flagged := format.lines(badJSON)
+		mu.Unlock()
+		badJSONFile := *outputPtr + "_badjson.txt"
+		if err := saveURLs(badJSONFile, flagged); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			exit(1)
+		}
+		fmt.Fprintf(report, "Found %d URLs without the expected JSON body. Saved to %s\n", len(flagged), badJSONFile)
+	}
+
+	// Save which scheme each host answered on (-both flag)
+	if *bothPtr && !*jsonPtr {
+		mu.Lock()
+		lines := make([]string, 0, len(schemes))
+		for host, scheme := range schemes {
+			lines = append(lines, host+"\t"+scheme)
+		}
+		mu.Unlock()
+		sort.Strings(lines)
+		schemeFile := *outputPtr + "_schemes.txt"
+		if err := saveURLs(schemeFile, lines); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			exit(1)
+		}
+		fmt.Fprintf(report, "Saved scheme map for %d hosts to %s\n", len(lines), schemeFile)
+	}
+
+	// Report Content-Security-Policy coverage (-csp and -csp-value flags)
+	if cfg.CSP {
+		mu.Lock()
+		stats.printCSP(report)
+		lines := append([]string(nil), policies...)
+		mu.Unlock()
+		if cfg.CSPValues && !*jsonPtr {
+			sort.Strings(lines)
+			cspFile := *outputPtr + "_csp.txt"
+			if err := saveURLs(cspFile, lines); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				exit(1)
+			}
+			fmt.Fprintf(report, "Saved %d Content-Security-Policy values to %s\n", len(lines), cspFile)
+		}
+	}
+
+	// Report missing security headers per URL (-security-headers flag)
+	if cfg.SecurityHeaders != nil {
+		mu.Lock()
+		stats.printHeaders(report, cfg.SecurityHeaders)
+		lines := append([]string(nil), missingHeaders...)
+		mu.Unlock()
+		if !*jsonPtr {
+			sort.Strings(lines)
+			headersFile := *outputPtr + "_missing_headers.txt"
+			if err := saveURLs(headersFile, lines); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+				exit(1)
+			}
+			fmt.Fprintf(report, "Found %d URLs missing security headers. Saved to %s\n", len(lines), headersFile)
+		}
+	}
+
+	if *statsPtr {
+		mu.Lock()
+		stats.print(report)
+		mu.Unlock()
+	}
+
+	// Fail the run if any URL did not return the expected status (-expect flag)
+	exitCode := 0
+	wrongStatus := false
+	if *expectPtr != 0 {
+		mu.Lock()
+		failed := append([]scan.Result(nil), mismatches...)
+		mu.Unlock()
+		if len(failed) > 0 {
+			sort.Slice(failed, func(i, j int) bool { return failed[i].URL < failed[j].URL })
+			for _, result := range failed {
+				if result.Err != nil {
+					fmt.Fprintf(os.Stderr, "[MISMATCH] %s: expected %d, got error: %v\n", result.URL, *expectPtr, result.Err)
+				} else {
+					fmt.Fprintf(os.Stderr, "[MISMATCH] %s: expected %d, got %d\n", result.URL, *expectPtr, result.StatusCode)
+					wrongStatus = true
+				}
+			}
+			fmt.Fprintf(os.Stderr, "%d URLs did not return status %d\n", len(failed), *expectPtr)
+			exitCode = exitExpectFailed
+		}
+	}
+
+	// Fail the run if any request got no response (-error-exit flag). A wrong
+	// status still wins, so exitErrors means everything that answered was fine
+	if *errorExitPtr {
+		mu.Lock()
+		failed := 0
+		for _, results := range failures {
+			failed += len(results)
+		}
+		mu.Unlock()
+		if failed > 0 {
+			fmt.Fprintf(os.Stderr, "%d URLs failed with transport errors\n", failed)
+			if !wrongStatus {
+				exitCode = exitErrors
+			}
+		}
+	}
+
+	// Fail the run if nothing matched (-fail-if-empty flag, implied by --only
+	// unless turned off with -fail-if-empty=false)
+	failIfEmpty := *failIfEmptyPtr || *onlyPtr != ""
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "fail-if-empty" {
+			failIfEmpty = *failIfEmptyPtr
+		}
+	})
+	if failIfEmpty && exitCode == 0 {
+		mu.Lock()
+		matched := 0
+		for status, statusResults := range results {
+			if filter.keep(status) {
+				matched += len(statusResults)
+			}
+		}
+		mu.Unlock()
+		if matched == 0 {
+			fmt.Fprintln(os.Stderr, "No URLs matched")
+			exitCode = exitEmpty
+		}
+	}
+	exit(exitCode)
 }
\ No newline at end of file
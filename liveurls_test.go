@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/siuxsa/liveurls/scan"
+)
+
+func TestMakeOutputDir(t *testing.T) {
+	root := t.TempDir()
+	prefix := filepath.Join(root, "logs", "daily", "status")
+	if err := makeOutputDir(prefix); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(root, "logs", "daily")); err != nil || !info.IsDir() {
+		t.Fatalf("output directory not created: %v", err)
+	}
+	// The directory already existing is fine, and results can be saved in it
+	if err := makeOutputDir(prefix); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveURLs(prefix+"_2xx.txt", []string{"http://example.com/"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A file where the directory should go is reported before scanning
+	blocked := filepath.Join(root, "file")
+	if err := os.WriteFile(blocked, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := makeOutputDir(filepath.Join(blocked, "status")); err == nil {
+		t.Error("makeOutputDir under a file: no error")
+	}
+}
+
+func TestEncodeURL(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"http://example.com/path with space", "http://example.com/path%20with%20space"},
+		{"http://example.com/a b?q=x y#frag ment", "http://example.com/a%20b?q=x%20y#frag%20ment"},
+		{"http://example.com/caf\u00e9/\u65e5\u672c", "http://example.com/caf%C3%A9/%E6%97%A5%E6%9C%AC"},
+		{"http://example.com/already%20encoded%2Fslash", "http://example.com/already%20encoded%2Fslash"},
+		{"http://example.com/lower%2fhex%c3%a9", "http://example.com/lower%2fhex%c3%a9"},
+		{"http://example.com/100%", "http://example.com/100%25"},
+		{"http://example.com/50%off", "http://example.com/50%25off"},
+		{"http://example.com/%4", "http://example.com/%254"},
+		{"http://example.com/a\"b<c>d{e}f|g", "http://example.com/a%22b%3Cc%3Ed%7Be%7Df%7Cg"},
+		{"http://example.com/keep/?a=1&b=2;c=3", "http://example.com/keep/?a=1&b=2;c=3"},
+		{"example.com/no scheme", "example.com/no%20scheme"},
+		{"http://example.com", "http://example.com"},
+		{"http://ex ample.com", "http://ex ample.com"}, // The host is never touched
+	}
+	for _, tt := range tests {
+		got := encodeURL(tt.in)
+		if got != tt.want {
+			t.Errorf("encodeURL(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+		if again := encodeURL(got); again != got {
+			t.Errorf("encodeURL(%q) = %q, not idempotent", got, again)
+		}
+	}
+}
+
+func TestEncodeURLParses(t *testing.T) {
+	// Encoded URLs parse, and decode back to the path that was typed
+	for _, path := range []string{"/path with space", "/caf\u00e9/\u65e5\u672c", "/100%", "/a\"b<c>"} {
+		encoded := encodeURL("http://example.com" + path)
+		u, err := url.Parse(encoded)
+		if err != nil {
+			t.Errorf("url.Parse(%q): %v", encoded, err)
+			continue
+		}
+		if u.Path != path {
+			t.Errorf("%q decodes to path %q, want %q", encoded, u.Path, path)
+		}
+	}
+}
+
+func TestParseStatusRanges(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int // Sampled codes that must match; nil for no filter
+		not  []int // Codes that must not match
+	}{
+		{"", nil, nil},
+		{"2xx", []int{200, 204, 299}, []int{199, 300, 404}},
+		{"200,404", []int{200, 404}, []int{201, 403, 500}},
+		{"200,301,5xx", []int{200, 301, 500, 503, 599}, []int{201, 302, 404}},
+		{" 200 , 3XX ,, 404 ", []int{200, 300, 399, 404}, []int{201, 400}},
+		{"2xx,204", []int{200, 204, 299}, []int{300}}, // Overlaps are fine
+		{"100,599", []int{100, 599}, []int{101, 598}},
+	}
+	for _, tt := range tests {
+		got, err := parseStatusRanges(tt.in)
+		if err != nil {
+			t.Errorf("parseStatusRanges(%q): %v", tt.in, err)
+			continue
+		}
+		if tt.want == nil {
+			if got != nil {
+				t.Errorf("parseStatusRanges(%q) = %v, want nil", tt.in, got)
+			}
+			continue
+		}
+		for _, code := range tt.want {
+			if !got[code] {
+				t.Errorf("parseStatusRanges(%q) doesn't match %d", tt.in, code)
+			}
+		}
+		for _, code := range tt.not {
+			if got[code] {
+				t.Errorf("parseStatusRanges(%q) matches %d", tt.in, code)
+			}
+		}
+	}
+
+	// Exact codes add only themselves
+	got, _ := parseStatusRanges("200, 404")
+	var codes []int
+	for code := range got {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	if len(codes) != 2 || codes[0] != 200 || codes[1] != 404 {
+		t.Errorf(`parseStatusRanges("200, 404") = %v, want [200 404]`, codes)
+	}
+}
+
+func TestParseStatusRangesInvalid(t *testing.T) {
+	for _, in := range []string{
+		"ok",
+		"200,ok",
+		"6xx",
+		"0xx",
+		"2x",
+		"2xxx",
+		"20",
+		"2000",
+		"099",
+		"600",
+		"+200",
+		"-200",
+		"2 00",
+		"200;404",
+	} {
+		if got, err := parseStatusRanges(in); err == nil {
+			t.Errorf("parseStatusRanges(%q) = %v, want an error", in, got)
+		}
+	}
+}
+
+func TestCheckRate(t *testing.T) {
+	tests := []struct {
+		rate, concurrency, burst int
+		strict                   bool
+		want                     int // 0 when the flags are rejected
+	}{
+		{10, 0, 1, false, 10}, // -c defaults to -d
+		{10, 50, 1, false, 50},
+		{0, 50, 1, false, 50}, // -d 0 is no limit, capped by -c
+		{0, 0, 1, false, 0},   // No limit at all
+		{0, 50, 1, true, 0},   // -strict-rate needs a rate
+		{-1, 0, 1, false, 0},
+		{-1, 50, 1, false, 0},
+		{-100, 0, 1, false, 0},
+		{10, -1, 1, false, 0},
+		{10, 0, 0, false, 0},
+		{10, 0, 5, false, 10},
+		{10, 0, 5, true, 0},
+		{10, 0, 1, true, 10},
+	}
+	for _, tt := range tests {
+		got, err := checkRate(tt.rate, tt.concurrency, tt.burst, tt.strict)
+		if tt.want == 0 {
+			if err == nil {
+				t.Errorf("checkRate(-d %d -c %d -burst %d strict %v) = %d, want an error", tt.rate, tt.concurrency, tt.burst, tt.strict, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("checkRate(-d %d -c %d -burst %d strict %v) = %d, %v, want %d", tt.rate, tt.concurrency, tt.burst, tt.strict, got, err, tt.want)
+		}
+	}
+}
+
+func TestReadURLsLongLines(t *testing.T) {
+	huge := strings.Repeat("x", 3<<20) // Past any fixed line buffer
+	input := "http://a.example\n" + huge + "\n  http://b.example  \r\n\n" + huge + "\nhttp://c.example"
+	tests := []struct {
+		maxLen  int
+		want    []string
+		skipped int
+	}{
+		{8192, []string{"http://a.example", "http://b.example", "http://c.example"}, 2},
+		{16, []string{"http://a.example", "http://b.example", "http://c.example"}, 2}, // Surrounding spaces don't count
+		{15, nil, 5},
+		{0, []string{"http://a.example", huge, "http://b.example", huge, "http://c.example"}, 0},
+		{4 << 20, []string{"http://a.example", huge, "http://b.example", huge, "http://c.example"}, 0},
+	}
+	for _, tt := range tests {
+		urls, skipped, err := readURLs(strings.NewReader(input), tt.maxLen)
+		if err != nil {
+			t.Errorf("readURLs(max %d): %v", tt.maxLen, err)
+			continue
+		}
+		if skipped != tt.skipped || strings.Join(urls, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("readURLs(max %d) kept %d URLs and skipped %d, want %d and %d", tt.maxLen, len(urls), skipped, len(tt.want), tt.skipped)
+		}
+	}
+}
+
+func TestMisplacedFlag(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "-list.txt")
+	if err := os.WriteFile(file, []byte("example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		args []string
+		want string // Empty when nothing is misplaced
+	}{
+		{[]string{"example.com"}, ""},
+		{[]string{"example.com", "-v"}, "-v"},
+		{[]string{"list.txt", "--only", "2xx"}, "--only"},
+		{[]string{"example.com", "-"}, "-"},
+		{[]string{file}, ""}, // Given after --
+		{nil, ""},
+	}
+	for _, tt := range tests {
+		got, ok := misplacedFlag(tt.args)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("misplacedFlag(%q) = %q, %v, want %q", tt.args, got, ok, tt.want)
+		}
+	}
+}
+
+func TestOutputSetInterruptMidWrite(t *testing.T) {
+	dir := t.TempDir()
+	var outputs outputSet
+	csvFile, err := outputs.create(filepath.Join(dir, "out.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonFile, err := outputs.create(filepath.Join(dir, "out.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := csvFile.writeLine(csvLine(csvHeader)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Several workers write results while the scan is interrupted. Lines
+	// are long enough that the buffer fills and flushes mid-run
+	const workers = 8
+	var written atomic.Int64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			<-start
+			for i := 0; ; i++ {
+				url := fmt.Sprintf("http://example.com/%d/%d/%s", w, i, strings.Repeat("x", 200))
+				record := []string{url, "200", "12", "", "-1", "Server, with \"quotes\""}
+				line, _ := json.Marshal(jsonResult{URL: url, Status: 200})
+				if csvFile.writeLine(csvLine(record)) != nil || jsonFile.writeLine(string(line)) != nil {
+					return // Closed by the interrupt
+				}
+				written.Add(1)
+			}
+		}(w)
+	}
+	close(start)
+	for written.Load() < 1000 {
+		runtime.Gosched()
+	}
+	if err := outputs.closeAll(); err != nil { // What the interrupt path runs
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if err := outputs.closeAll(); err != nil {
+		t.Errorf("second closeAll: %v", err)
+	}
+	if err := csvFile.writeLine("late"); err == nil {
+		t.Error("writeLine after closeAll: no error")
+	}
+
+	// Every line written before the interrupt is there in full, and nothing else
+	data, err := os.ReadFile(filepath.Join(dir, "out.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		t.Fatalf("out.csv is not valid CSV: %v", err)
+	}
+	csvRows := 0
+	for i, record := range records {
+		if i == 0 {
+			continue // Header
+		}
+		if len(record) != len(csvHeader) || record[1] != "200" || !strings.HasSuffix(record[0], strings.Repeat("x", 200)) {
+			t.Fatalf("out.csv row %d is incomplete: %q", i, record)
+		}
+		csvRows++
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, "out.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(data), "\n") {
+		t.Error("out.json doesn't end with a complete line")
+	}
+	jsonRows := 0
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		var result jsonResult
+		if err := json.Unmarshal([]byte(line), &result); err != nil || result.Status != 200 {
+			t.Fatalf("out.json line %d is incomplete: %q", jsonRows+1, line)
+		}
+		jsonRows++
+	}
+
+	// A worker can be cut off between its two writes, so the CSV may hold
+	// one more row per worker than the count of finished pairs
+	n := int(written.Load())
+	if csvRows < n || csvRows > n+workers {
+		t.Errorf("out.csv has %d rows, want %d to %d", csvRows, n, n+workers)
+	}
+	if jsonRows != n {
+		t.Errorf("out.json has %d lines, want %d", jsonRows, n)
+	}
+}
+
+func TestInBaseline(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "baseline.txt")
+	if err := os.WriteFile(file, []byte("example.com\nhttps://Secure.example.com/login/\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := loadBaseline(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url, input string
+		want       bool
+	}{
+		{"http://example.com", "example.com", true},
+		{"https://example.com", "example.com", true}, // Scheme picked by -probe-https
+		{"https://example.com/", "https://example.com/", false},
+		{"https://secure.example.com/login", "https://secure.example.com/login", true},
+		{"http://secure.example.com/login", "secure.example.com/login", false},
+		{"https://new.example.com", "new.example.com", false},
+	}
+	for _, tt := range tests {
+		r := scan.Result{URL: tt.url, Input: tt.input}
+		if got := inBaseline(baseline, r); got != tt.want {
+			t.Errorf("inBaseline(%s, input %s) = %v, want %v", tt.url, tt.input, got, tt.want)
+		}
+	}
+}
\ No newline at end of file
@@ -0,0 +1,290 @@
+package scan
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"strconv"
+)
+
+// mmdbMarker starts the metadata section at the end of a MaxMind DB file
+var mmdbMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdbMetadataMax is how far from the end of the file the metadata may start
+const mmdbMetadataMax = 128 << 10
+
+// maxMMDBDepth bounds nesting and pointer chains, so a corrupt file can't
+// recurse forever
+const maxMMDBDepth = 32
+
+var errMMDBData = errors.New("data section is truncated or corrupt")
+
+// mmdb is a MaxMind DB (.mmdb) file held in memory: a binary search tree
+// over address bits whose leaves point into a data section. The format is
+// described at https://maxmind.github.io/MaxMind-DB/
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint64
+	recordSize uint64 // Bits per record: 24, 28 or 32
+	ipv6       bool
+	ipv4Start  uint64 // Node reached after the 96 zero bits of ::/96
+}
+
+// isMMDB reports whether buf ends with a MaxMind DB metadata section
+func isMMDB(buf []byte) bool {
+	return bytes.Contains(mmdbTail(buf), mmdbMarker)
+}
+
+// mmdbTail returns the part of buf the metadata has to be in
+func mmdbTail(buf []byte) []byte {
+	if len(buf) > mmdbMetadataMax {
+		return buf[len(buf)-mmdbMetadataMax:]
+	}
+	return buf
+}
+
+// parseMMDB reads the metadata of a MaxMind DB file and sets up lookups
+func parseMMDB(buf []byte) (*mmdb, error) {
+	tail := mmdbTail(buf)
+	i := bytes.LastIndex(tail, mmdbMarker)
+	if i < 0 {
+		return nil, errors.New("MaxMind DB metadata not found")
+	}
+	metaStart := len(buf) - len(tail) + i
+	meta, _, err := decodeMMDB(buf[metaStart+len(mmdbMarker):], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %v", err)
+	}
+	fields, ok := meta.(map[string]any)
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+	if version, _ := fields["binary_format_major_version"].(uint64); version != 2 {
+		return nil, fmt.Errorf("unsupported MaxMind DB format version %d", version)
+	}
+	db := &mmdb{}
+	db.nodeCount, _ = fields["node_count"].(uint64)
+	db.recordSize, _ = fields["record_size"].(uint64)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	switch ipVersion, _ := fields["ip_version"].(uint64); ipVersion {
+	case 4:
+	case 6:
+		db.ipv6 = true
+	default:
+		return nil, fmt.Errorf("unsupported IP version %d", ipVersion)
+	}
+
+	// Two records per node, then 16 zero bytes before the data section
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint64(metaStart) {
+		return nil, errors.New("search tree runs past the end of the file")
+	}
+	db.tree = buf[:treeSize]
+	db.data = buf[treeSize+16 : metaStart]
+	if db.ipv6 {
+		// IPv4 addresses live at ::a.b.c.d in an IPv6 tree
+		for bit := 0; bit < 96 && db.ipv4Start < db.nodeCount; bit++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (0) or right (1) record of a search tree node
+func (db *mmdb) record(node uint64, side uint64) uint64 {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6+side*3:]
+		return uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+	case 28:
+		// The middle byte holds the top four bits of both records
+		b := db.tree[node*7:]
+		if side == 0 {
+			return uint64(b[3]&0xf0)<<20 | uint64(b[0])<<16 | uint64(b[1])<<8 | uint64(b[2])
+		}
+		return uint64(b[3]&0x0f)<<24 | uint64(b[4])<<16 | uint64(b[5])<<8 | uint64(b[6])
+	}
+	return uint64(binary.BigEndian.Uint32(db.tree[node*8+side*4:]))
+}
+
+// lookup returns the data record for addr, if the database has one
+func (db *mmdb) lookup(addr netip.Addr) (map[string]any, bool) {
+	var ip []byte
+	node := uint64(0)
+	switch {
+	case addr.Is4() && db.ipv6:
+		ip4 := addr.As4()
+		ip, node = ip4[:], db.ipv4Start
+	case addr.Is4():
+		ip4 := addr.As4()
+		ip = ip4[:]
+	case db.ipv6:
+		ip16 := addr.As16()
+		ip = ip16[:]
+	default:
+		return nil, false // IPv6 address in an IPv4-only database
+	}
+	for bit := 0; bit < len(ip)*8 && node < db.nodeCount; bit++ {
+		node = db.record(node, uint64(ip[bit/8]>>(7-bit%8)&1))
+	}
+	// node_count itself means no data; larger values point into the data section
+	if node <= db.nodeCount {
+		return nil, false
+	}
+	value, _, err := decodeMMDB(db.data, node-db.nodeCount-16, 0)
+	if err != nil {
+		return nil, false
+	}
+	record, ok := value.(map[string]any)
+	return record, ok
+}
+
+// geo returns the ASN and country recorded for addr, if any
+func (db *mmdb) geo(addr netip.Addr) (geoRange, bool) {
+	record, ok := db.lookup(addr)
+	if !ok {
+		return geoRange{}, false
+	}
+	return mmdbGeo(record), true
+}
+
+// decodeMMDB decodes the data section value at off, returning it with the
+// offset just past it. Integers of every width decode to uint64 (int32 to
+// int64), doubles and floats to float64, maps to map[string]any and
+// arrays to []any
+func decodeMMDB(data []byte, off uint64, depth int) (any, uint64, error) {
+	if depth > maxMMDBDepth || off >= uint64(len(data)) {
+		return nil, 0, errMMDBData
+	}
+	ctrl := data[off]
+	off++
+	kind := ctrl >> 5
+	if kind == 1 {
+		// Pointer: 1 to 4 more bytes give an offset into the data section
+		n := uint64(ctrl>>3&3) + 1
+		if off+n > uint64(len(data)) {
+			return nil, 0, errMMDBData
+		}
+		target := uint64(ctrl & 7)
+		if n == 4 {
+			target = 0
+		}
+		for _, b := range data[off : off+n] {
+			target = target<<8 | uint64(b)
+		}
+		target += [...]uint64{0, 2048, 526336, 0}[n-1]
+		value, _, err := decodeMMDB(data, target, depth+1)
+		return value, off + n, err
+	}
+	if kind == 0 {
+		// Extended type, given by the next byte
+		if off >= uint64(len(data)) {
+			return nil, 0, errMMDBData
+		}
+		kind = 7 + data[off]
+		off++
+	}
+	size := uint64(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > uint64(len(data)) {
+			return nil, 0, errMMDBData
+		}
+		var extra uint64
+		for _, b := range data[off : off+n] {
+			extra = extra<<8 | uint64(b)
+		}
+		off += n
+		size = [...]uint64{29, 285, 65821}[n-1] + extra
+	}
+
+	switch kind {
+	case 7: // Map
+		m := make(map[string]any)
+		for i := uint64(0); i < size; i++ {
+			key, next, err := decodeMMDB(data, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errMMDBData
+			}
+			if m[name], off, err = decodeMMDB(data, next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case 11: // Array
+		var a []any
+		for i := uint64(0); i < size; i++ {
+			value, next, err := decodeMMDB(data, off, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a, off = append(a, value), next
+		}
+		return a, off, nil
+	case 14: // Boolean, held in the size
+		return size != 0, off, nil
+	}
+
+	if off+size > uint64(len(data)) {
+		return nil, 0, errMMDBData
+	}
+	b := data[off : off+size]
+	off += size
+	switch kind {
+	case 2: // UTF-8 string
+		return string(b), off, nil
+	case 3: // Double
+		if size != 8 {
+			return nil, 0, errMMDBData
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), off, nil
+	case 4, 10: // Bytes, and uint128 which nothing read here needs as a number
+		return b, off, nil
+	case 5, 6, 8, 9: // uint16, uint32, int32, uint64
+		if size > 8 {
+			return nil, 0, errMMDBData
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		if kind == 8 {
+			return int64(int32(uint32(n))), off, nil
+		}
+		return n, off, nil
+	case 15: // Float
+		if size != 4 {
+			return nil, 0, errMMDBData
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), off, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// mmdbGeo picks the fields liveurls reports out of a MaxMind record: the
+// autonomous_system_* fields of ASN databases and country.iso_code (or
+// registered_country.iso_code) of Country and City ones
+func mmdbGeo(record map[string]any) geoRange {
+	var r geoRange
+	if n, ok := record["autonomous_system_number"].(uint64); ok {
+		r.asn = strconv.FormatUint(n, 10)
+	}
+	r.org, _ = record["autonomous_system_organization"].(string)
+	for _, key := range []string{"country", "registered_country"} {
+		country, _ := record[key].(map[string]any)
+		if r.country, _ = country["iso_code"].(string); r.country != "" {
+			break
+		}
+	}
+	return r
+}
\ No newline at end of file
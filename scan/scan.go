@@ -0,0 +1,1526 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+// Result is the outcome of probing one URL. Fields filled by an optional
+// check are left zero when the Scanner doesn't run it
+type Result struct {
+	URL            string
+	Input          string // The URL as it appeared in the probe list, before a scheme was added
+	StatusCode     int
+	Err            error // Set when no response was received
+	CheckedAt      time.Time
+	Latency        time.Duration // Until the final response arrived, redirects included
+	Proto          string        // Negotiated protocol, e.g. HTTP/1.1 or HTTP/2.0
+	IP             string        // Address the connection was made to
+	ASN            string        // Filled from Scanner.Geo when the IP is found
+	ASOrg          string
+	Country        string
+	JSONIssue      string   // Why the body failed ExpectJSON, empty if it passed
+	FinalURL       string   // Where the URL ended up, if it was redirected
+	Redirects      int      // Number of redirects followed, meta refreshes included
+	RedirectChain  []string // URLs redirected to on the way to FinalURL
+	Cipher         string   // Negotiated TLS cipher suite, empty for plain http
+	Preview        string   // Start of the body, cleaned up for one-line display
+	AltSvc         string   // Alt-Svc header advertising e.g. HTTP/3 endpoints
+	Cookies        []string // Set-Cookie names, or name=value with CookieValues
+	CSP            string   // Content-Security-Policy value, kept with CSPValues
+	HasCSP         bool     // Response set Content-Security-Policy (CSP)
+	MissingHeaders []string // SecurityHeaders the response did not send
+	Size           int64    // Body length in bytes, -1 if unknown
+	Truncated      bool     // The body was measured but ran past MaxBodyBytes, so Size is -1
+	ContentLength  int64    // Content-Length header, -1 if absent (chunked)
+	Server         string   // Server header
+	Charset        string   // Declared charset, lowercased (Charset)
+	Location       string   // Where a 3xx response points (Location)
+	WeakCipher     bool     // Cipher is in Scanner.WeakCiphers
+}
+
+// details returns the extra fields shown after the status in verbose output
+func (r Result) details() string {
+	parts := []string{fmt.Sprintf("length: %d", r.ContentLength)}
+	if r.Server != "" {
+		parts = append(parts, "server: "+r.Server)
+	}
+	if r.Redirects > 0 {
+		parts = append(parts, fmt.Sprintf("redirects: %d", r.Redirects))
+	}
+	if r.ASN != "" {
+		parts = append(parts, fmt.Sprintf("%s AS%s %s %s", r.IP, r.ASN, r.Country, r.ASOrg))
+	}
+	if r.Location != "" {
+		parts = append(parts, "location: "+r.Location)
+	}
+	if r.Charset != "" {
+		parts = append(parts, "charset: "+r.Charset)
+	}
+	if r.AltSvc != "" {
+		parts = append(parts, "alt-svc: "+r.AltSvc)
+	}
+	if len(r.Cookies) > 0 {
+		parts = append(parts, "cookies: "+strings.Join(r.Cookies, " "))
+	}
+	return " [" + strings.Join(parts, ", ") + "]"
+}
+
+// DefaultWeakCiphers returns the cipher suites Go considers insecure
+func DefaultWeakCiphers() map[string]bool {
+	weak := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		weak[suite.Name] = true
+	}
+	return weak
+}
+
+// DefaultSecurityHeaders is the standard set of headers to check for.
+// Add to it here, or per run with the command's -check-headers
+var DefaultSecurityHeaders = []string{
+	"Strict-Transport-Security",
+	"Content-Security-Policy",
+	"X-Frame-Options",
+	"X-Content-Type-Options",
+	"Referrer-Policy",
+}
+
+// Scanner probes lists of URLs and reports the status each one answers
+// with. Set the fields, then call Scan; New returns a Scanner with the
+// same defaults as the liveurls command
+type Scanner struct {
+	Rate        int           // Requests started per second, 0 for no limit
+	Burst       int           // Requests that may start back to back after a lull
+	Concurrency int           // Requests in flight at once
+	Timeout     time.Duration // Per URL, counting redirects and the body; 0 for none
+	Header      http.Header   // Sent with every request
+	Method      string        // HEAD, retried with GET when unsupported, or GET
+	Retries     int           // Extra attempts after errors and 429/503
+
+	MaxRedirects   int           // After this many redirects the 3xx response is the result
+	MaxHeaderBytes int64         // Largest response header block accepted
+	Insecure       bool          // Accept any TLS certificate
+	Proxy          *url.URL      // nil to use the proxy environment variables
+	CacheDNS       bool          // Resolve every host once before scanning and reuse the addresses
+	NoDrain        bool          // Close bodies without reading the rest
+	GlobalThrottle bool          // Pause every host, not just the sender, on 429/503
+	MaxThrottle    time.Duration // Longest pause a 429/503 can cause; 0 for no limit
+	HostDelay      time.Duration // Minimum gap between requests to the same host
+
+	Geo              *GeoDB          // Annotates results with ASN and country when set
+	WeakCiphers      map[string]bool // Cipher suite names flagged as weak when negotiated
+	OfferWeakCiphers bool            // Also offer the WeakCiphers suites Go implements
+
+	ExpectJSON bool   // Require a JSON body
+	ExpectKey  string // Top-level key the JSON object must contain, with ExpectJSON
+	FollowMeta bool   // Follow <meta http-equiv="refresh"> redirects
+
+	Location    bool // Record Location on 3xx responses
+	Charset     bool // Record the declared charset
+	MetaCharset bool // Also look for <meta charset> in HTML bodies, with Charset
+
+	PreviewBytes int // Capture this much of the body, at most MaxBodyBytes
+
+	Cookies      bool // Record Set-Cookie names
+	CookieValues bool // Keep cookie values too, with Cookies
+
+	CSP       bool // Check for Content-Security-Policy
+	CSPValues bool // Keep the policy itself, with CSP
+
+	SecurityHeaders []string // Headers to check for, e.g. DefaultSecurityHeaders
+
+	MinSize int64 // Smallest body passing SizeOK, in bytes
+	MaxSize int64 // Largest body passing SizeOK, in bytes; 0 for no limit
+
+	RetryOtherScheme bool // Retry failed requests over the other scheme
+	RaceSchemes      bool // Race http:// and https:// for scheme-less input
+	ProbeHTTPS       bool // Try https:// before http:// for scheme-less input
+
+	// Log receives the verbose [CHECK], [ERROR], [RETRY], ... lines. It
+	// may be written from several goroutines, one line per write
+	Log io.Writer
+}
+
+// New returns a Scanner with the liveurls command's defaults
+func New() *Scanner {
+	return &Scanner{
+		Rate:           10,
+		Burst:          1,
+		Concurrency:    10,
+		Timeout:        10 * time.Second,
+		Header:         http.Header{"User-Agent": {"liveurls/1.0"}},
+		Method:         http.MethodHead,
+		MaxRedirects:   10,
+		MaxHeaderBytes: 1 << 20,
+		MaxThrottle:    defaultMaxThrottle,
+		WeakCiphers:    DefaultWeakCiphers(),
+	}
+}
+
+// Scan starts probing urls and returns a channel that receives a Result
+// for each URL as it finishes, whether it answered or failed. The channel
+// is closed once every URL is done. Cancelling ctx stops the scan: no new
+// requests start, the ones in flight are cut short and send nothing, and
+// the channel is closed, whether or not anyone is still reading. Until
+// then results must be read, or the scan stalls
+//
+// Scan returns an error without starting if the settings are invalid
+func (s *Scanner) Scan(ctx context.Context, urls []string) (<-chan Result, error) {
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	cfg := &probeConfig{
+		Scanner:  *s, // Changes to s don't reach a running scan
+		verbose:  s.Log != nil,
+		log:      s.Log,
+		throttle: newThrottle(s.GlobalThrottle),
+		spacer:   newHostSpacer(s.HostDelay),
+	}
+	if cfg.Method == "" {
+		cfg.Method = http.MethodHead
+	}
+	if s.Rate > 0 {
+		cfg.limiter = newTokenBucket(s.Rate, s.Burst)
+	}
+
+	opts := clientOptions{
+		maxHeaderBytes: s.MaxHeaderBytes,
+		maxRedirects:   s.MaxRedirects,
+		timeout:        s.Timeout,
+		insecure:       s.Insecure,
+		proxy:          s.Proxy,
+		idlePerHost:    s.Concurrency, // Never more than this many in flight at once
+		pace:           cfg.pace,
+	}
+	if s.OfferWeakCiphers {
+		// Only on request: by default the client never offers a weak suite
+		opts.cipherSuites = offeredCiphers(s.WeakCiphers)
+	}
+	if s.CacheDNS {
+		opts.dns = newDNSCache()
+	}
+	cfg.client = newHTTPClient(opts)
+
+	results := make(chan Result, resultBuffer)
+	go func() {
+		if opts.dns != nil {
+			warmDNS(ctx, opts.dns, urls, cfg)
+		}
+		processURLs(ctx, urls, results, cfg.Concurrency, cfg)
+		close(results)
+	}()
+	return results, nil
+}
+
+// warmDNS resolves every host in urls once before the scan starts, so the
+// requests reuse the answers. Cancelling ctx cuts it short
+func warmDNS(ctx context.Context, dns *dnsCache, urls []string, cfg *probeConfig) {
+	seen := make(map[string]bool)
+	var hosts []string
+	for _, u := range urls {
+		if host := HostOf(u); host != "" && !seen[host] {
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	start := time.Now()
+	failed := dns.warm(ctx, hosts, dnsWarmupWorkers)
+	if cfg.verbose && ctx.Err() == nil {
+		fmt.Fprintf(cfg.log, "[DNS] resolved %d of %d hosts in %v\n", len(hosts)-failed, len(hosts), time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// validate rejects settings Scan can't run with
+func (s *Scanner) validate() error {
+	switch {
+	case s.Rate < 0:
+		return fmt.Errorf("invalid Rate %d: must be 0 (no limit) or more", s.Rate)
+	case s.Burst < 0:
+		return fmt.Errorf("invalid Burst %d: must be 0 or more", s.Burst)
+	case s.Concurrency < 1:
+		return fmt.Errorf("invalid Concurrency %d: must be 1 or more", s.Concurrency)
+	case s.Timeout < 0:
+		return fmt.Errorf("invalid Timeout %v: must be 0 (none) or more", s.Timeout)
+	case s.Method != "" && s.Method != http.MethodHead && s.Method != http.MethodGet:
+		return fmt.Errorf("invalid Method %q: must be HEAD or GET", s.Method)
+	case s.Retries < 0:
+		return fmt.Errorf("invalid Retries %d: must be 0 or more", s.Retries)
+	case s.MaxThrottle < 0:
+		return fmt.Errorf("invalid MaxThrottle %v: must be 0 (no limit) or more", s.MaxThrottle)
+	case s.PreviewBytes < 0 || s.PreviewBytes > MaxBodyBytes:
+		return fmt.Errorf("invalid PreviewBytes %d: must be between 0 and %d", s.PreviewBytes, MaxBodyBytes)
+	case s.MinSize < 0 || s.MaxSize < 0 || (s.MaxSize > 0 && s.MaxSize < s.MinSize):
+		return fmt.Errorf("invalid size range MinSize %d MaxSize %d", s.MinSize, s.MaxSize)
+	}
+	return nil
+}
+
+// probeConfig is a Scanner's settings plus the state of one Scan, shared
+// by every request
+type probeConfig struct {
+	Scanner
+	client   *http.Client
+	verbose  bool
+	log      io.Writer // Where verbose lines go, nil unless verbose
+	throttle *throttle
+	spacer   *hostSpacer
+	limiter  *tokenBucket // Paces request starts to Rate; nil when there is no limit
+}
+
+// pacedKey is the context key under which pace adds up how long a URL's
+// requests waited to start, so the wait can be left out of its latency
+type pacedKey struct{}
+
+// pace waits until a request to host may start: past any 429/503 pause and
+// the HostDelay gap, and with a token from the rate limiter. Every request
+// goes through it, HEAD to GET fallbacks, scheme retries, meta refreshes
+// and redirects included, so nothing pushes the scan past Rate
+func (cfg *probeConfig) pace(ctx context.Context, host string) error {
+	start := time.Now()
+	err := cfg.throttle.wait(ctx, host)
+	if err == nil {
+		err = cfg.spacer.wait(ctx, host)
+	}
+	if err == nil {
+		err = cfg.limiter.wait(ctx)
+	}
+	addPaced(ctx, time.Since(start))
+	return err
+}
+
+// addPaced adds d to the pacing total carried by ctx, if there is one
+func addPaced(ctx context.Context, d time.Duration) {
+	if total, ok := ctx.Value(pacedKey{}).(*atomic.Int64); ok {
+		total.Add(int64(d))
+	}
+}
+
+// needBody reports whether requests must use GET to inspect the body
+func (s *Scanner) needBody() bool {
+	return s.ExpectJSON || s.FollowMeta || s.MetaCharset || s.PreviewBytes > 0
+}
+
+// sizeFilter reports whether MinSize or MaxSize is set
+func (s *Scanner) sizeFilter() bool {
+	return s.MinSize > 0 || s.MaxSize > 0
+}
+
+// SizeOK reports whether r's body passes MinSize and MaxSize. Scan measures
+// Size whenever either is set but leaves filtering to the caller. A
+// truncated body is known to be longer than MaxBodyBytes, which fails a
+// smaller MaxSize and passes a smaller MinSize; other bodies of unknown
+// size are kept
+func (s *Scanner) SizeOK(r Result) bool {
+	if r.Truncated {
+		if s.MaxSize > 0 && s.MaxSize <= MaxBodyBytes {
+			return false
+		}
+		return true // Either passes MinSize, or can't be told apart
+	}
+	if r.Size < 0 {
+		return true
+	}
+	return r.Size >= s.MinSize && (s.MaxSize == 0 || r.Size <= s.MaxSize)
+}
+
+// bodyPreview returns up to n bytes of body as a single printable line
+func bodyPreview(body []byte, n int) string {
+	if len(body) > n {
+		body = body[:n]
+	}
+	text := strings.ToValidUTF8(string(body), "")
+	text = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case !unicode.IsPrint(r):
+			return -1
+		}
+		return r
+	}, text)
+	return strings.Join(strings.Fields(text), " ")
+}
+
+// maxMetaRefreshes caps how many meta refresh redirects are followed, so
+// pages refreshing to themselves cannot loop forever
+const maxMetaRefreshes = 5
+
+var (
+	metaTagRe     = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	metaRefreshRe = regexp.MustCompile(`(?is)http-equiv\s*=\s*["']?refresh`)
+	metaContentRe = regexp.MustCompile(`(?is)content\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+	refreshURLRe  = regexp.MustCompile(`(?is)^\s*\d*(?:\.\d*)?\s*[;,]?\s*url\s*=\s*['"]?([^'"]+)`)
+)
+
+// metaRefreshTarget returns the absolute URL a page redirects to through a
+// <meta http-equiv="refresh"> tag, or "" if it has none
+func metaRefreshTarget(body []byte, base *url.URL) string {
+	for _, tag := range metaTagRe.FindAll(body, -1) {
+		if !metaRefreshRe.Match(tag) {
+			continue
+		}
+		content := metaContentRe.FindSubmatch(tag)
+		if content == nil {
+			continue
+		}
+		value := string(content[1]) + string(content[2]) + string(content[3])
+		target := refreshURLRe.FindStringSubmatch(value)
+		if target == nil {
+			continue
+		}
+		next, err := base.Parse(strings.TrimSpace(target[1]))
+		if err != nil || (next.Scheme != "http" && next.Scheme != "https") {
+			continue
+		}
+		return next.String()
+	}
+	return ""
+}
+
+// MaxBodyBytes caps how much of a response body is read for inspection
+const MaxBodyBytes = 1 << 20
+
+// readBody reads up to MaxBodyBytes of body, reporting whether it went on
+// past that
+func readBody(body io.Reader) ([]byte, bool, error) {
+	data, err := io.ReadAll(io.LimitReader(body, MaxBodyBytes+1))
+	if len(data) > MaxBodyBytes {
+		return data[:MaxBodyBytes], true, err
+	}
+	return data, false, err
+}
+
+// checkJSON returns why body is not acceptable JSON, or "" if it is. When key
+// is set the body must be an object with that top-level key.
+func checkJSON(body []byte, key string) string {
+	if !json.Valid(body) {
+		if len(body) >= MaxBodyBytes {
+			return "body is not valid JSON (truncated at 1MB)"
+		}
+		return "body is not valid JSON"
+	}
+	if key == "" {
+		return ""
+	}
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(body, &object); err != nil {
+		return "body is not a JSON object"
+	}
+	if _, ok := object[key]; !ok {
+		return fmt.Sprintf("missing key %q", key)
+	}
+	return ""
+}
+
+// metaCharsetPrescan is how far into an HTML document browsers look for a
+// <meta> charset declaration
+const metaCharsetPrescan = 1024
+
+var metaCharsetRe = regexp.MustCompile(`(?is)charset\s*=\s*["']?([\w.:-]+)`)
+
+// declaredCharset returns the charset a response declares in its
+// Content-Type header or, for HTML, in a <meta charset> or http-equiv tag
+// near the top of body. The name is lowercased but not validated, and
+// nothing is transcoded
+func declaredCharset(contentType string, body []byte) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err == nil && params["charset"] != "" {
+		return strings.ToLower(params["charset"])
+	}
+	if err == nil && mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return ""
+	}
+	if len(body) > metaCharsetPrescan {
+		body = body[:metaCharsetPrescan]
+	}
+	for _, tag := range metaTagRe.FindAll(body, -1) {
+		if m := metaCharsetRe.FindSubmatch(tag); m != nil {
+			return strings.ToLower(string(m[1]))
+		}
+	}
+	return ""
+}
+
+// defaultThrottlePause is how long a host is left alone after a 429 or 503
+// that carries no usable Retry-After header
+const defaultThrottlePause = 5 * time.Second
+
+// defaultMaxThrottle caps the pause a Retry-After header can ask for, so a
+// server answering "come back tomorrow" can't stall the scan
+const defaultMaxThrottle = 30 * time.Second
+
+// throttle holds back requests after a server answers 429 or 503. By default
+// only the host that answered is paused; with global set every request waits.
+// Waiting requests keep their worker, so a paused host with many URLs queued
+// can hold every worker until the pause ends
+type throttle struct {
+	mu     sync.Mutex
+	global bool
+	until  map[string]time.Time // Keyed by host, or "" when global
+}
+
+func newThrottle(global bool) *throttle {
+	return &throttle{global: global, until: make(map[string]time.Time)}
+}
+
+func (t *throttle) key(host string) string {
+	if t.global {
+		return ""
+	}
+	return host
+}
+
+// wait blocks until requests to host may resume or ctx is done
+func (t *throttle) wait(ctx context.Context, host string) error {
+	t.mu.Lock()
+	until := t.until[t.key(host)]
+	t.mu.Unlock()
+	return sleepContext(ctx, time.Until(until))
+}
+
+// sleepContext pauses for d, returning early with ctx's error if it is
+// cancelled first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// pause holds back requests to host for d, never shortening an earlier pause
+func (t *throttle) pause(host string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := t.key(host)
+	if until := time.Now().Add(d); until.After(t.until[key]) {
+		t.until[key] = until
+	}
+}
+
+// hostSpacer keeps a minimum gap between requests to the same host
+type hostSpacer struct {
+	mu   sync.Mutex
+	gap  time.Duration
+	next map[string]time.Time // Earliest time the next request to a host may start
+}
+
+func newHostSpacer(gap time.Duration) *hostSpacer {
+	return &hostSpacer{gap: gap, next: make(map[string]time.Time)}
+}
+
+// wait blocks until at least gap has passed since the last request to host
+// began, reserving the slot so concurrent callers queue up behind it
+func (s *hostSpacer) wait(ctx context.Context, host string) error {
+	if s.gap <= 0 {
+		return ctx.Err()
+	}
+	s.mu.Lock()
+	now := time.Now()
+	at := s.next[host]
+	if at.Before(now) {
+		at = now
+	}
+	s.next[host] = at.Add(s.gap)
+	s.mu.Unlock()
+	return sleepContext(ctx, time.Until(at))
+}
+
+// tokenBucket is a token-bucket rate limiter that lets at most burst
+// requests start back to back before falling to one per interval. Every
+// request takes a token, retries included, so nothing pushes the scan
+// faster than Rate. It tracks when the next token is due rather than
+// counting ticks, so timer jitter doesn't add up and the rate holds over
+// any window
+type tokenBucket struct {
+	mu       sync.Mutex
+	interval time.Duration
+	burst    int
+	tat      time.Time // Theoretical arrival time of the next request at the steady rate
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{interval: time.Second / time.Duration(rate), burst: burst}
+}
+
+// reserve takes a token and returns how long the caller must wait before
+// using it. With burst=1 successive reservations are always at least one
+// interval apart, however late the previous caller was
+func (b *tokenBucket) reserve() time.Duration {
+	return b.reserveAt(time.Now())
+}
+
+func (b *tokenBucket) reserveAt(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tat.Before(now) {
+		b.tat = now
+	}
+	wait := b.tat.Sub(now) - time.Duration(b.burst-1)*b.interval
+	b.tat = b.tat.Add(b.interval)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// wait blocks until the caller's token is due, or ctx is done. A nil
+// bucket never waits
+func (b *tokenBucket) wait(ctx context.Context) error {
+	if b == nil {
+		return ctx.Err()
+	}
+	return sleepContext(ctx, b.reserve())
+}
+
+// retryAfter returns the delay asked for by a Retry-After header, given
+// either in seconds or as an HTTP date, or fallback when there is none
+func retryAfter(resp *http.Response, fallback time.Duration) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return fallback
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		if d := time.Until(when); d > 0 {
+			return d
+		}
+		return 0
+	}
+	return fallback
+}
+
+// clientOptions configures the HTTP client shared by every request
+type clientOptions struct {
+	maxHeaderBytes int64     // Largest response header block accepted
+	maxRedirects   int       // After this many redirects the 3xx response is the result
+	dns            *dnsCache // nil to resolve hosts on every dial
+	timeout        time.Duration
+	insecure       bool                                         // Accept any certificate
+	proxy          *url.URL                                     // nil to use the proxy environment variables
+	idlePerHost    int                                          // Idle keep-alive connections kept per host
+	cipherSuites   []uint16                                     // TLS 1.2 suites to offer, nil for Go's defaults
+	pace           func(ctx context.Context, host string) error // Run before following each redirect
+}
+
+// offeredCiphers returns the TLS 1.2 suites to offer so that hosts
+// accepting only a weak one still connect and get flagged: Go's default
+// suites plus every suite in weak that Go implements. Go's client never
+// offers its insecure suites or RSA key exchange unless asked to, so they
+// could otherwise never be negotiated. It returns nil when weak adds
+// nothing to the defaults
+func offeredCiphers(weak map[string]bool) []uint16 {
+	var suites []uint16
+	extra := false
+	for _, suite := range tls.CipherSuites() {
+		rsaKex := strings.HasPrefix(suite.Name, "TLS_RSA_")
+		if !rsaKex || weak[suite.Name] {
+			suites = append(suites, suite.ID)
+			extra = extra || rsaKex
+		}
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		if weak[suite.Name] {
+			suites = append(suites, suite.ID)
+			extra = true
+		}
+	}
+	if !extra {
+		return nil
+	}
+	return suites // Go's client lists the secure suites first whatever the order
+}
+
+// newHTTPClient builds the client shared by every request
+func newHTTPClient(opts clientOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxResponseHeaderBytes = opts.maxHeaderBytes
+	// The default of 2 idle connections per host makes scans of a single
+	// host close and redial most connections, leaving sockets in TIME_WAIT
+	transport.MaxIdleConnsPerHost = opts.idlePerHost
+	// Keep an overall cap too, so scans across many hosts don't hold a
+	// socket open per host until the idle timeout
+	if transport.MaxIdleConns < opts.idlePerHost {
+		transport.MaxIdleConns = opts.idlePerHost
+	}
+	if opts.insecure || opts.cipherSuites != nil {
+		transport.TLSClientConfig = &tls.Config{
+			InsecureSkipVerify: opts.insecure,
+			CipherSuites:       opts.cipherSuites,
+		}
+	}
+	if opts.proxy != nil {
+		transport.Proxy = http.ProxyURL(opts.proxy)
+	}
+	if opts.dns != nil {
+		transport.DialContext = opts.dns.dialContext
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   opts.timeout, // Covers connecting, redirects and reading the body
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > opts.maxRedirects {
+				return http.ErrUseLastResponse
+			}
+			if opts.pace != nil {
+				if err := opts.pace(req.Context(), HostOf(req.URL.String())); err != nil {
+					return err
+				}
+			}
+			if chain, ok := req.Context().Value(redirectChainKey{}).(*[]string); ok {
+				*chain = append(*chain, req.URL.String())
+			}
+			return nil
+		},
+	}
+}
+
+// dnsCache resolves each host once for the whole run and dials the cached
+// addresses, so URLs sharing a host don't repeat the lookup
+type dnsCache struct {
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+	dialer  *net.Dialer
+}
+
+// lookupHost resolves host names for dnsCache; tests swap in a fake resolver
+var lookupHost = net.DefaultResolver.LookupHost
+
+type dnsEntry struct {
+	ready chan struct{} // Closed once addrs and err are set
+	addrs []string
+	err   error
+}
+
+func newDNSCache() *dnsCache {
+	return &dnsCache{
+		entries: make(map[string]*dnsEntry),
+		dialer:  &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second},
+	}
+}
+
+// lookup returns the addresses for host, resolving it on first use.
+// Failures are cached too, so a dead name is only looked up once.
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[host]
+	if !ok {
+		entry = &dnsEntry{ready: make(chan struct{})}
+		c.entries[host] = entry
+	}
+	c.mu.Unlock()
+	if !ok {
+		// Not bound to ctx, so one cancelled request can't cache a failure
+		// for everyone; the caller still stops waiting when ctx is done
+		resolve := lookupHost
+		go func() {
+			lookupCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			entry.addrs, entry.err = resolve(lookupCtx, host)
+			cancel()
+			close(entry.ready)
+		}()
+	}
+	select {
+	case <-entry.ready:
+		return entry.addrs, entry.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// warm resolves hosts ahead of the scan using up to workers lookups at once
+// and returns how many could not be resolved. It returns early once ctx is
+// cancelled, leaving the remaining hosts to be looked up on first use
+func (c *dnsCache) warm(ctx context.Context, hosts []string, workers int) int {
+	hostChan := make(chan string)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range hostChan {
+				if _, err := c.lookup(ctx, host); err != nil && ctx.Err() == nil {
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+feed:
+	for _, host := range hosts {
+		select {
+		case hostChan <- host:
+		case <-ctx.Done():
+			break feed // Stop handing out hosts once stopped
+		}
+	}
+	close(hostChan)
+	wg.Wait()
+	return failed
+}
+
+// dialContext is a Transport.DialContext that connects to the cached
+// addresses of the host, trying each in turn
+func (c *dnsCache) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return c.dialer.DialContext(ctx, network, addr)
+	}
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range addrs {
+		var conn net.Conn
+		if conn, err = c.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// dnsWarmupWorkers is how many lookups CacheDNS runs at once before the scan
+const dnsWarmupWorkers = 32
+
+// maxDrainBytes bounds how much of an unread body is discarded to let the
+// connection be reused; larger bodies are cheaper to drop with the connection
+const maxDrainBytes = 256 << 10
+
+// closeBody discards what is left of body so the connection can go back to
+// the pool, then closes it. Recent Go releases drain small bodies on Close
+// themselves, but only for 50ms; older ones drop the connection
+func closeBody(body io.ReadCloser, cfg *probeConfig) {
+	if !cfg.NoDrain {
+		io.Copy(io.Discard, io.LimitReader(body, maxDrainBytes))
+	}
+	body.Close()
+}
+
+// geoRange is one line of an ip2asn-style database
+type geoRange struct {
+	start, end netip.Addr
+	asn        string
+	country    string
+	org        string
+}
+
+// GeoDB maps IP addresses to ASN and country from offline databases
+type GeoDB struct {
+	sources []geoSource // In the order they were given
+}
+
+// geoSource is one loaded database
+type geoSource interface {
+	geo(addr netip.Addr) (geoRange, bool)
+}
+
+// geoRanges is an ip2asn database, sorted by start address
+type geoRanges []geoRange
+
+// LoadGeoDB reads one or more offline databases: MaxMind DB (.mmdb) files
+// such as GeoLite2-ASN and GeoLite2-Country, and tab-separated ip2asn
+// databases (iptoasn.com format: range_start, range_end, AS_number,
+// country_code, AS_description). Each is recognised by its content. An
+// address takes each field from the first database that has it, so an ASN
+// database and a country one can be combined
+func LoadGeoDB(filenames ...string) (*GeoDB, error) {
+	db := &GeoDB{}
+	for _, filename := range filenames {
+		buf, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("error opening geo database %s: %v", filename, err)
+		}
+		source, err := parseGeoDB(filename, buf)
+		if err != nil {
+			return nil, err
+		}
+		db.sources = append(db.sources, source)
+	}
+	return db, nil
+}
+
+// parseGeoDB parses the database read from filename
+func parseGeoDB(filename string, buf []byte) (geoSource, error) {
+	if isMMDB(buf) {
+		m, err := parseMMDB(buf)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing geo database %s: %v", filename, err)
+		}
+		return m, nil
+	}
+	// Text databases never contain NUL bytes
+	head := buf
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	if bytes.IndexByte(head, 0) >= 0 || strings.EqualFold(filepath.Ext(filename), ".mmdb") {
+		return nil, fmt.Errorf("error parsing geo database %s: not a MaxMind DB or ip2asn TSV file", filename)
+	}
+
+	var ranges geoRanges
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("error parsing geo database %s line %d: expected at least 4 tab-separated fields", filename, line)
+		}
+		start, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing geo database %s line %d: %v", filename, line, err)
+		}
+		end, err := netip.ParseAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("error parsing geo database %s line %d: %v", filename, line, err)
+		}
+		r := geoRange{start: start.Unmap(), end: end.Unmap(), asn: fields[2], country: fields[3]}
+		if len(fields) > 4 {
+			r.org = fields[4]
+		}
+		ranges = append(ranges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading geo database %s: %v", filename, err)
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start.Less(ranges[j].start) })
+	return ranges, nil
+}
+
+// lookup returns what the databases know about ip, if anything
+func (db *GeoDB) lookup(ip string) (geoRange, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return geoRange{}, false
+	}
+	addr = addr.Unmap()
+	var result geoRange
+	found := false
+	for _, source := range db.sources {
+		r, ok := source.geo(addr)
+		if !ok {
+			continue
+		}
+		found = true
+		if result.asn == "" {
+			result.asn, result.org = r.asn, r.org
+		}
+		if result.country == "" {
+			result.country = r.country
+		}
+	}
+	return result, found
+}
+
+// geo returns the range containing addr, if any
+func (ranges geoRanges) geo(addr netip.Addr) (geoRange, bool) {
+	// Find the last range starting at or before addr
+	i := sort.Search(len(ranges), func(i int) bool { return addr.Less(ranges[i].start) }) - 1
+	if i < 0 || ranges[i].end.Less(addr) || ranges[i].asn == "0" {
+		return geoRange{}, false
+	}
+	return ranges[i], true
+}
+
+// swapScheme switches an http:// URL to https:// and vice versa
+func swapScheme(url string) string {
+	if rest, ok := strings.CutPrefix(url, "https://"); ok {
+		return "http://" + rest
+	}
+	return "https://" + strings.TrimPrefix(url, "http://")
+}
+
+// AddScheme adds the http:// prefix if protocol is missing
+func AddScheme(url string) string {
+	if !HasScheme(url) {
+		return "http://" + url
+	}
+	return url
+}
+
+// HasScheme reports whether url starts with http:// or https://
+func HasScheme(url string) bool {
+	return strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://")
+}
+
+// HostOf returns the lowercase host name of a URL, adding a scheme if needed
+func HostOf(rawURL string) string {
+	u, err := url.Parse(AddScheme(rawURL))
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// ErrorCategory sorts a request error into a broad failure reason:
+// dns, timeout, refused, reset, tls or other
+func ErrorCategory(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.As(err, &recordErr), errors.As(err, &certErr), errors.As(err, &authorityErr),
+		errors.As(err, &hostnameErr), errors.As(err, &invalidErr), strings.Contains(err.Error(), "tls: "):
+		return "tls"
+	}
+	return "other"
+}
+
+// headUnsupported reports whether a HEAD request should be retried with
+// GET: the server answered 405 or 501, or the request failed in a way that
+// could be down to the method. DNS failures and refused connections would
+// fail the same way over GET
+func headUnsupported(resp *http.Response, err error) bool {
+	if err != nil {
+		category := ErrorCategory(err)
+		return category != "dns" && category != "refused"
+	}
+	return resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented
+}
+
+// schemeRetryable reports whether a failed request is worth retrying over
+// the other scheme: the connection was refused, reset, timed out or failed
+// TLS, as it does when only the other port is served. DNS failures and
+// errors from a server that did answer would fail the same way again
+func schemeRetryable(err error) bool {
+	switch ErrorCategory(err) {
+	case "tls", "refused", "reset", "timeout":
+		return true
+	}
+	return false
+}
+
+// requestInfo describes how a request was carried out
+type requestInfo struct {
+	ip        string   // Address the (last) connection was made to
+	reused    bool     // The connection came from the idle pool
+	redirects int      // HTTP redirects followed
+	chain     []string // Each URL redirected to, in order
+}
+
+// redirectChainKey is the context key under which CheckRedirect finds the
+// chain of the request being followed
+type redirectChainKey struct{}
+
+// doRequest sends a request and returns the response along with the IP
+// address the connection was made to and the redirects it followed.
+// Servers may reset pooled connections that sat idle, so an idempotent
+// request that is reset on a reused connection is sent once more on a
+// fresh one before the error is reported.
+func doRequest(ctx context.Context, cfg *probeConfig, method, url string) (*http.Response, requestInfo, error) {
+	resp, info, err := sendRequest(ctx, cfg, method, url)
+	if err != nil && info.reused && ErrorCategory(err) == "reset" &&
+		(method == http.MethodHead || method == http.MethodGet) {
+		resp, info, err = sendRequest(ctx, cfg, method, url)
+	}
+	return resp, info, err
+}
+
+// sendRequest makes a single attempt at a request, once pace lets it start
+func sendRequest(ctx context.Context, cfg *probeConfig, method, url string) (*http.Response, requestInfo, error) {
+	var info requestInfo
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, info, err
+	}
+	if err := cfg.pace(ctx, HostOf(url)); err != nil {
+		return nil, info, err
+	}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(conn httptrace.GotConnInfo) {
+			if host, _, err := net.SplitHostPort(conn.Conn.RemoteAddr().String()); err == nil {
+				info.ip = host
+			}
+			info.reused = conn.Reused
+		},
+	}
+	ctx = context.WithValue(ctx, redirectChainKey{}, &info.chain)
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+	for name, values := range cfg.Header {
+		req.Header[name] = values
+	}
+	if host := cfg.Header.Get("Host"); host != "" {
+		req.Host = host // Go sends req.Host, not a Host entry in req.Header
+	}
+	resp, err := cfg.client.Do(req)
+	info.redirects = len(info.chain)
+	return resp, info, err
+}
+
+// cancelOnClose releases a request's context once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// raceSchemes requests a scheme-less URL over https:// and http:// at the
+// same time. The first success wins and the slower request is cancelled; if
+// both fail the two errors are returned together.
+func raceSchemes(ctx context.Context, cfg *probeConfig, method, url string) (*http.Response, requestInfo, string, error) {
+	type attempt struct {
+		resp  *http.Response
+		info  requestInfo
+		url   string
+		err   error
+		paced time.Duration
+	}
+	targets := []string{"https://" + url, "http://" + url}
+	cancels := make([]context.CancelFunc, len(targets))
+	attempts := make(chan attempt, len(targets))
+	for i, target := range targets {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+		go func(target string) {
+			// Each side has its own pacing total; only the winner's counts
+			var paced atomic.Int64
+			resp, info, err := doRequest(context.WithValue(attemptCtx, pacedKey{}, &paced), cfg, method, target)
+			attempts <- attempt{resp, info, target, err, time.Duration(paced.Load())}
+		}(target)
+	}
+
+	var errs []error
+	for range targets {
+		a := <-attempts
+		if a.err != nil {
+			errs = append(errs, a.err)
+			continue
+		}
+		// Stop the loser and keep the winner's context alive until its body is closed
+		for i, target := range targets {
+			if target == a.url {
+				a.resp.Body = cancelOnClose{a.resp.Body, cancels[i]}
+			} else {
+				cancels[i]()
+			}
+		}
+		go func(pending int) {
+			// The loser may still have got a response before being cancelled
+			for ; pending > 0; pending-- {
+				if late := <-attempts; late.resp != nil {
+					late.resp.Body.Close()
+				}
+			}
+		}(len(targets) - len(errs) - 1)
+		addPaced(ctx, a.paced)
+		return a.resp, a.info, a.url, nil
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+	return nil, requestInfo{}, "https://" + url, fmt.Errorf("%w; %w", errs[0], errs[1])
+}
+
+// fetch makes one attempt at url: racing or adding the scheme, retrying
+// over the other scheme and falling back from HEAD to GET as configured.
+// It returns the URL that answered, with its scheme
+func fetch(ctx context.Context, cfg *probeConfig, method, url string) (*http.Response, requestInfo, string, error) {
+	var resp *http.Response
+	var info requestInfo
+	var err error
+	raced := cfg.RaceSchemes && !HasScheme(url)
+	probed := cfg.ProbeHTTPS && !HasScheme(url)
+	if raced {
+		// Race http:// and https:// for scheme-less input (RaceSchemes)
+		resp, info, url, err = raceSchemes(ctx, cfg, method, url)
+		if cfg.verbose && err == nil {
+			fmt.Fprintf(cfg.log, "[RACE] %s: %s answered first\n", url, strings.SplitN(url, ":", 2)[0])
+		}
+	} else {
+		if probed {
+			url = "https://" + url // Try HTTPS first (ProbeHTTPS)
+		} else {
+			url = AddScheme(url)
+		}
+		resp, info, err = doRequest(ctx, cfg, method, url)
+	}
+	if err != nil && (cfg.RetryOtherScheme || probed) && !raced && ctx.Err() == nil && schemeRetryable(err) {
+		// The host may only be set up on the other scheme
+		other := swapScheme(url)
+		if cfg.verbose {
+			fmt.Fprintf(cfg.log, "[RETRY] %s: %v, trying %s\n", url, err, other)
+		}
+		if resp, info, err = doRequest(ctx, cfg, method, other); err == nil {
+			url = other // Record the scheme that worked
+		}
+	}
+	if method == http.MethodHead && ctx.Err() == nil && headUnsupported(resp, err) {
+		// Many servers don't implement HEAD, so ask again with GET and keep
+		// that answer. The HEAD result stands if GET fails too
+		if cfg.verbose {
+			reason := fmt.Sprintf("HEAD failed: %v", err)
+			if err == nil {
+				reason = fmt.Sprintf("HEAD returned %d", resp.StatusCode)
+			}
+			fmt.Fprintf(cfg.log, "[GET] %s: %s, retrying with GET\n", url, reason)
+		}
+		if next, nextInfo, nextErr := doRequest(ctx, cfg, http.MethodGet, url); nextErr == nil {
+			if err == nil {
+				closeBody(resp.Body, cfg)
+			}
+			resp, info, err = next, nextInfo, nil
+		}
+	}
+	return resp, info, url, err
+}
+
+// retryBackoff is the wait before the first retry; it doubles
+// with every further attempt
+const retryBackoff = 500 * time.Millisecond
+
+// retryableError reports whether a failed request may succeed if tried
+// again. A host that does not exist will not appear on a retry
+func retryableError(err error) bool {
+	var dnsErr *net.DNSError
+	if err == nil || (errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return false
+	}
+	return true
+}
+
+// checkURL probes one URL and sends the result to outputChan. Requests
+// run under ctx; once it is cancelled nothing more is sent, since a
+// request cut short by shutdown says nothing about the URL
+func checkURL(ctx context.Context, url string, outputChan chan<- Result, cfg *probeConfig) {
+	input := url
+	host := HostOf(url)
+
+	// Make HEAD request to check status code, or GET when the body is needed
+	method := cfg.Method
+	if cfg.needBody() || cfg.sizeFilter() {
+		method = http.MethodGet
+	}
+	var resp *http.Response
+	var info requestInfo
+	var err error
+	var latency time.Duration
+	for attempt := 0; ; attempt++ {
+		var paced atomic.Int64
+		start := time.Now()
+		resp, info, url, err = fetch(context.WithValue(ctx, pacedKey{}, &paced), cfg, method, input)
+		// Time until the final response's headers, including redirects but
+		// not the time spent waiting for the rate limit
+		latency = time.Since(start) - time.Duration(paced.Load())
+		overloaded := err == nil && (resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable)
+
+		// Back off when the server says it is overloaded: later requests to
+		// the host (or to every host with GlobalThrottle) wait, retries or not
+		if overloaded {
+			pause := retryAfter(resp, defaultThrottlePause)
+			if cfg.MaxThrottle > 0 && pause > cfg.MaxThrottle {
+				pause = cfg.MaxThrottle
+			}
+			cfg.throttle.pause(host, pause)
+			if cfg.verbose {
+				scope := host
+				if cfg.throttle.global {
+					scope = "all hosts"
+				}
+				fmt.Fprintf(cfg.log, "[THROTTLE] %s: %d, pausing %s for %v\n", url, resp.StatusCode, scope, pause)
+			}
+		}
+
+		if attempt == cfg.Retries || ctx.Err() != nil || !(overloaded || retryableError(err)) {
+			break
+		}
+		// Wait out the backoff; the next request then waits for any
+		// Retry-After pause and a token like every other one
+		delay := retryBackoff << attempt
+		if cfg.verbose {
+			reason := fmt.Sprint(err)
+			if err == nil {
+				reason = fmt.Sprint(resp.StatusCode)
+			}
+			fmt.Fprintf(cfg.log, "[RETRY] %s: %s, attempt %d of %d in %v\n", url, reason, attempt+1, cfg.Retries, delay)
+		}
+		if err == nil {
+			closeBody(resp.Body, cfg)
+		}
+		if sleepContext(ctx, delay) != nil {
+			return // Cancelled by shutdown
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		return // Cancelled by shutdown
+	}
+	if err != nil {
+		if category := ErrorCategory(err); cfg.verbose && category == "timeout" {
+			fmt.Fprintf(cfg.log, "[TIMEOUT] %s: %v\n", url, err)
+		} else if cfg.verbose {
+			fmt.Fprintf(cfg.log, "[ERROR] %s (%s): %v\n", url, category, err)
+		}
+		// Errors are not saved, but are counted
+		sendResult(ctx, outputChan, Result{URL: url, Input: input, Err: err, CheckedAt: time.Now(), Latency: latency})
+		return // Silently skip errors if not verbose
+	}
+	defer func() { closeBody(resp.Body, cfg) }() // resp changes while following meta refreshes
+
+	// Chunked responses have no Content-Length, so size filters have to
+	// read the body to find out how long it is
+	var body []byte
+	var truncated bool
+	var bodyErr error
+	if cfg.needBody() || (cfg.sizeFilter() && resp.ContentLength < 0) {
+		body, truncated, bodyErr = readBody(resp.Body)
+	}
+
+	// Follow <meta http-equiv="refresh"> redirects (FollowMeta)
+	page := url
+	if cfg.FollowMeta {
+		for depth := 0; depth < maxMetaRefreshes && bodyErr == nil; depth++ {
+			target := metaRefreshTarget(body, resp.Request.URL)
+			if target == "" || target == resp.Request.URL.String() {
+				break // No refresh, or the page just reloads itself
+			}
+			next, nextInfo, err := doRequest(ctx, cfg, http.MethodGet, target)
+			if err != nil {
+				if cfg.verbose {
+					fmt.Fprintf(cfg.log, "[ERROR] %s: %v\n", target, err)
+				}
+				break // Keep the last page that loaded
+			}
+			if cfg.verbose {
+				fmt.Fprintf(cfg.log, "[META] %s -> %s\n", page, target)
+			}
+			closeBody(resp.Body, cfg)
+			nextInfo.redirects += info.redirects + 1 // The refresh counts as a hop too
+			nextInfo.chain = append(append(info.chain, target), nextInfo.chain...)
+			resp, info, page = next, nextInfo, target
+			body, truncated, bodyErr = readBody(resp.Body)
+		}
+	}
+
+	result := Result{
+		URL:           url,
+		Input:         input,
+		StatusCode:    resp.StatusCode,
+		CheckedAt:     time.Now(),
+		Latency:       latency,
+		Proto:         resp.Proto,
+		AltSvc:        strings.Join(resp.Header.Values("Alt-Svc"), ", "),
+		IP:            info.ip,
+		Redirects:     info.redirects,
+		RedirectChain: info.chain,
+		Size:          resp.ContentLength,
+		ContentLength: resp.ContentLength, // Stays -1 when size is measured from the body
+		Server:        resp.Header.Get("Server"),
+	}
+	if result.Size < 0 && cfg.sizeFilter() && bodyErr == nil {
+		if truncated {
+			result.Truncated = true
+		} else {
+			result.Size = int64(len(body))
+		}
+	}
+	// resp.Request is the last request made, after any redirects
+	if finalURL := resp.Request.URL.String(); finalURL != url {
+		result.FinalURL = finalURL
+	}
+	if resp.TLS != nil {
+		result.Cipher = tls.CipherSuiteName(resp.TLS.CipherSuite)
+		result.WeakCipher = cfg.WeakCiphers[result.Cipher]
+	}
+	if cfg.Geo != nil {
+		if r, ok := cfg.Geo.lookup(info.ip); ok {
+			result.ASN, result.ASOrg, result.Country = r.asn, r.org, r.country
+		}
+	}
+
+	if cfg.PreviewBytes > 0 {
+		result.Preview = bodyPreview(body, cfg.PreviewBytes)
+	}
+
+	// Values are often session tokens, so only names are kept unless asked
+	if cfg.Cookies {
+		for _, cookie := range resp.Cookies() {
+			if cfg.CookieValues {
+				result.Cookies = append(result.Cookies, cookie.Name+"="+cookie.Value)
+			} else {
+				result.Cookies = append(result.Cookies, cookie.Name)
+			}
+		}
+	}
+
+	// Only redirects that were not followed are still 3xx here
+	if cfg.Location && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		if target, err := resp.Location(); err == nil {
+			result.Location = target.String()
+		} else {
+			result.Location = resp.Header.Get("Location")
+		}
+	}
+
+	if cfg.Charset {
+		var html []byte
+		if cfg.MetaCharset {
+			html = body
+		}
+		result.Charset = declaredCharset(resp.Header.Get("Content-Type"), html)
+	}
+
+	if cfg.CSP {
+		policy := strings.Join(resp.Header.Values("Content-Security-Policy"), ", ")
+		result.HasCSP = policy != ""
+		if cfg.CSPValues {
+			result.CSP = policy
+		}
+	}
+
+	for _, name := range cfg.SecurityHeaders {
+		if resp.Header.Get(name) == "" {
+			result.MissingHeaders = append(result.MissingHeaders, name)
+		}
+	}
+
+	if cfg.ExpectJSON {
+		if bodyErr != nil {
+			result.JSONIssue = fmt.Sprintf("error reading body: %v", bodyErr)
+		} else {
+			result.JSONIssue = checkJSON(body, cfg.ExpectKey)
+		}
+	}
+
+	if cfg.verbose {
+		target := url
+		if result.FinalURL != "" {
+			target = url + " -> " + result.FinalURL
+		}
+		fmt.Fprintf(cfg.log, "[CHECK] %s: %d (%v)%s\n", target, resp.StatusCode, latency.Round(time.Millisecond), result.details())
+		if result.WeakCipher {
+			fmt.Fprintf(cfg.log, "[WEAKCIPHER] %s: %s\n", url, result.Cipher)
+		}
+		if result.JSONIssue != "" {
+			fmt.Fprintf(cfg.log, "[BADJSON] %s: %s\n", url, result.JSONIssue)
+		}
+		if cfg.CSP && !result.HasCSP {
+			fmt.Fprintf(cfg.log, "[NOCSP] %s\n", url)
+		}
+		if result.CSP != "" {
+			fmt.Fprintf(cfg.log, "[CSP] %s: %s\n", url, result.CSP)
+		}
+		if len(result.MissingHeaders) > 0 {
+			fmt.Fprintf(cfg.log, "[MISSING] %s: %s\n", url, strings.Join(result.MissingHeaders, ", "))
+		}
+		if result.Preview != "" {
+			fmt.Fprintf(cfg.log, "[PREVIEW] %s: %s\n", url, result.Preview)
+		}
+	}
+
+	sendResult(ctx, outputChan, result)
+}
+
+// resultBuffer is how many results may wait for the collector. Workers
+// block once it is full, so memory use doesn't grow with the input
+const resultBuffer = 64
+
+// sendResult sends r to outputChan, giving up once ctx is cancelled so a
+// caller that stops reading can't leave workers blocked. Results are still
+// delivered after cancellation while there is room for them
+func sendResult(ctx context.Context, outputChan chan<- Result, r Result) {
+	select {
+	case outputChan <- r:
+		return
+	default:
+	}
+	select {
+	case outputChan <- r:
+	case <-ctx.Done():
+	}
+}
+
+// processURLs checks urls with a fixed pool of concurrency workers. Every
+// request takes a token from cfg.limiter (see pace), so however many are
+// idle the scan never runs faster than the rate limit. A nil limiter means
+// no rate limit, so only the pool size gates requests
+//
+// Once ctx is cancelled no more requests start, in-flight ones are
+// cancelled through their request context, and processURLs returns when
+// they have all finished, so outputChan can be closed safely
+func processURLs(ctx context.Context, urls []string, outputChan chan<- Result, concurrency int, cfg *probeConfig) {
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for url := range jobs {
+				if ctx.Err() != nil {
+					return // Exit if stop signal received
+				}
+				checkURL(ctx, url, outputChan, cfg)
+			}
+		}()
+	}
+
+	defer wg.Wait()
+	defer close(jobs)
+	for _, url := range urls {
+		select {
+		case jobs <- url:
+		case <-ctx.Done():
+			return // Stop handing out URLs once stopped
+		}
+	}
+}
\ No newline at end of file
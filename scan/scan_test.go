@@ -0,0 +1,635 @@
+package scan
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// scanAll runs s over urls and returns the results keyed by URL
+func scanAll(t *testing.T, s *Scanner, urls ...string) map[string]Result {
+	t.Helper()
+	results, err := s.Scan(context.Background(), urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byURL := make(map[string]Result)
+	for r := range results {
+		byURL[r.URL] = r
+	}
+	return byURL
+}
+
+func TestChunkedBodySize(t *testing.T) {
+	chunk := strings.Repeat("x", 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunks := 2
+		if r.URL.Path == "/big" {
+			chunks = 2*MaxBodyBytes/len(chunk) + 1
+		}
+		for i := 0; i < chunks; i++ {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush() // No Content-Length, so the body is chunked
+		}
+	}))
+	defer srv.Close()
+
+	s := New()
+	s.Rate = 0
+	s.MinSize = 1
+	results := scanAll(t, s, srv.URL+"/small", srv.URL+"/big")
+
+	small := results[srv.URL+"/small"]
+	if small.Err != nil || small.ContentLength != -1 {
+		t.Fatalf("small: err %v, content length %d, want a chunked response", small.Err, small.ContentLength)
+	}
+	if small.Size != 2000 || small.Truncated {
+		t.Errorf("small: size %d, truncated %v, want 2000, false", small.Size, small.Truncated)
+	}
+	big := results[srv.URL+"/big"]
+	if big.Err != nil || big.Size != -1 || !big.Truncated {
+		t.Errorf("big: err %v, size %d, truncated %v, want nil, -1, true", big.Err, big.Size, big.Truncated)
+	}
+
+	tests := []struct {
+		min, max  int64
+		smallOK   bool
+		bigOK     bool
+		bigReason string
+	}{
+		{1, 0, true, true, "longer than any MinSize up to MaxBodyBytes"},
+		{3000, 0, false, true, "longer than MaxBodyBytes"},
+		{0, 1500, false, false, "longer than MaxBodyBytes"},
+		{0, MaxBodyBytes, true, false, "longer than MaxBodyBytes"},
+		{0, 2 * MaxBodyBytes, true, true, "size unknown past MaxBodyBytes, kept"},
+		{2 * MaxBodyBytes, 0, false, true, "size unknown past MaxBodyBytes, kept"},
+	}
+	for _, tt := range tests {
+		s.MinSize, s.MaxSize = tt.min, tt.max
+		if got := s.SizeOK(small); got != tt.smallOK {
+			t.Errorf("min %d max %d: SizeOK(small) = %v, want %v", tt.min, tt.max, got, tt.smallOK)
+		}
+		if got := s.SizeOK(big); got != tt.bigOK {
+			t.Errorf("min %d max %d: SizeOK(big) = %v, want %v (%s)", tt.min, tt.max, got, tt.bigOK, tt.bigReason)
+		}
+	}
+}
+
+func TestScanRates(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	// Rate 0 lifts the limit; it used to divide by zero
+	s := New()
+	s.Rate = 0
+	urls := []string{srv.URL + "/a", srv.URL + "/b", srv.URL + "/c"}
+	results := scanAll(t, s, urls...)
+	for _, u := range urls {
+		if r, ok := results[u]; !ok || r.StatusCode != http.StatusOK {
+			t.Errorf("Rate 0: %s got %+v", u, r)
+		}
+	}
+
+	for _, rate := range []int{-1, -100} {
+		s.Rate = rate
+		if _, err := s.Scan(context.Background(), urls); err == nil {
+			t.Errorf("Scan with Rate %d: no error", rate)
+		}
+	}
+}
+
+func TestTokenBucketSpacing(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name  string
+		burst int
+		calls []time.Duration // When each caller asks for a token, from base
+		want  []time.Duration // When each may start, from base
+	}{
+		{"all at once", 1,
+			[]time.Duration{0, 0, 0, 0},
+			[]time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond}},
+		{"slower than the rate", 1,
+			[]time.Duration{0, 250 * time.Millisecond, 600 * time.Millisecond},
+			[]time.Duration{0, 250 * time.Millisecond, 600 * time.Millisecond}},
+		{"late caller doesn't earn a burst", 1,
+			[]time.Duration{0, 150 * time.Millisecond, 160 * time.Millisecond, 170 * time.Millisecond},
+			[]time.Duration{0, 150 * time.Millisecond, 250 * time.Millisecond, 350 * time.Millisecond}},
+		{"burst", 3,
+			[]time.Duration{0, 0, 0, 0, 0},
+			[]time.Duration{0, 0, 0, 100 * time.Millisecond, 200 * time.Millisecond}},
+		{"burst refills after a lull", 2,
+			[]time.Duration{0, 0, 0, time.Second, time.Second, time.Second},
+			[]time.Duration{0, 0, 100 * time.Millisecond, time.Second, time.Second, 1100 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		b := newTokenBucket(int(time.Second/interval), tt.burst)
+		for i, call := range tt.calls {
+			start := call + b.reserveAt(base.Add(call))
+			if start != tt.want[i] {
+				t.Errorf("%s: call %d at %v starts at %v, want %v", tt.name, i, call, start, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestTokenBucketLongRun(t *testing.T) {
+	// However callers arrive, n starts at burst 1 span at least n-1 intervals
+	b := newTokenBucket(500, 1)
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := base
+	var last time.Time
+	for i := 0; i < 5000; i++ {
+		now = now.Add(time.Duration(i%7) * 300 * time.Microsecond) // Uneven arrivals
+		start := now.Add(b.reserveAt(now))
+		if i > 0 && start.Sub(last) < 2*time.Millisecond {
+			t.Fatalf("start %d only %v after the previous one", i, start.Sub(last))
+		}
+		last = start
+	}
+}
+
+func TestScanSpacing(t *testing.T) {
+	var mu sync.Mutex
+	var arrivals []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	s := New()
+	s.Rate = 20
+	s.Concurrency = 10
+	var urls []string
+	for i := 0; i < 10; i++ {
+		urls = append(urls, fmt.Sprintf("%s/%d", srv.URL, i))
+	}
+	scanAll(t, s, urls...)
+	if len(arrivals) != len(urls) {
+		t.Fatalf("%d requests arrived, want %d", len(arrivals), len(urls))
+	}
+	// Starts are scheduled exactly; allow a little for the first connection
+	span := arrivals[len(arrivals)-1].Sub(arrivals[0])
+	if want := time.Duration(len(urls)-1)*time.Second/20 - 20*time.Millisecond; span < want {
+		t.Errorf("%d requests at Rate 20 arrived within %v, want at least %v", len(urls), span, want)
+	}
+}
+
+// TestScanSpacingFollowUps checks that the GET sent after a HEAD is refused
+// waits for its own token instead of going straight out
+func TestScanSpacingFollowUps(t *testing.T) {
+	var mu sync.Mutex
+	var arrivals []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrivals = append(arrivals, time.Now())
+		mu.Unlock()
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+
+	s := New()
+	s.Rate = 10
+	s.Concurrency = 1
+	results := scanAll(t, s, srv.URL+"/a", srv.URL+"/b")
+	if r := results[srv.URL+"/a"]; r.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want the GET fallback's 200", r.StatusCode)
+	}
+	if len(arrivals) != 4 {
+		t.Fatalf("%d requests arrived, want a HEAD and a GET for each URL", len(arrivals))
+	}
+	for i := 1; i < len(arrivals); i++ {
+		if gap := arrivals[i].Sub(arrivals[i-1]); gap < 90*time.Millisecond {
+			t.Errorf("request %d arrived %v after the one before, want at least 100ms at Rate 10", i+1, gap)
+		}
+	}
+}
+
+// TestThrottlePerHostWithoutRetries checks that a 503 pauses the host that
+// sent it even when nothing will be retried
+func TestThrottlePerHostWithoutRetries(t *testing.T) {
+	var mu sync.Mutex
+	var arrivals []time.Time
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		arrivals = append(arrivals, time.Now())
+		if len(arrivals) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	s := New()
+	s.Rate = 0
+	s.Concurrency = 1
+	results := scanAll(t, s, srv.URL+"/a", srv.URL+"/b")
+	if r := results[srv.URL+"/a"]; r.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("first URL got status %d, want the 503 recorded", r.StatusCode)
+	}
+	if len(arrivals) != 2 {
+		t.Fatalf("%d requests arrived, want 2", len(arrivals))
+	}
+	if gap := arrivals[1].Sub(arrivals[0]); gap < 900*time.Millisecond {
+		t.Errorf("second request came %v after the 503, want a Retry-After pause of 1s", gap)
+	}
+}
+
+// TestWeakCiphersOptIn checks that weak suites are offered only when asked
+// for, so an RSA-kex-only host fails by default and is flagged when audited
+func TestWeakCiphersOptIn(t *testing.T) {
+	const weak = "TLS_RSA_WITH_AES_128_CBC_SHA"
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_RSA_WITH_AES_128_CBC_SHA}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	s := New()
+	s.Insecure = true
+	s.WeakCiphers = map[string]bool{weak: true}
+	if r := scanAll(t, s, srv.URL)[srv.URL]; r.Err == nil {
+		t.Errorf("got %s by default, want a TLS error since no weak suite is offered", r.Cipher)
+	}
+
+	s.OfferWeakCiphers = true
+	r := scanAll(t, s, srv.URL)[srv.URL]
+	if r.Err != nil || r.Cipher != weak || !r.WeakCipher {
+		t.Errorf("got cipher %q weak %v err %v with OfferWeakCiphers, want %s flagged as weak", r.Cipher, r.WeakCipher, r.Err, weak)
+	}
+}
+
+func TestSchemeRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, true},
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("remote error: tls: handshake failure"), true},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nosuch.invalid", IsNotFound: true}}, false},
+		{fmt.Errorf("net/http: server response headers exceeded 1024 bytes; aborted"), false},
+	}
+	for _, tt := range tests {
+		if got := schemeRetryable(tt.err); got != tt.want {
+			t.Errorf("schemeRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkSameHostGET measures GET probing of one host whose bodies are
+// never read, with and without draining them before close. conns/op shows
+// how many probes needed a new connection. Recent Go releases drain small
+// bodies on Close themselves for up to 50ms, so the difference shows on
+// bodies that take longer than that to arrive, and on older releases
+func BenchmarkSameHostGET(b *testing.B) {
+	chunk := []byte(strings.Repeat("x", 8<<10))
+	for _, bench := range []struct {
+		name    string
+		pause   time.Duration // Between the first and second half of the body
+		noDrain bool
+	}{
+		{"drain", 0, false},
+		{"no-drain", 0, true},
+		{"slow-body/drain", 60 * time.Millisecond, false},
+		{"slow-body/no-drain", 60 * time.Millisecond, true},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			var conns atomic.Int64
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write(chunk)
+				w.(http.Flusher).Flush()
+				time.Sleep(bench.pause)
+				w.Write(chunk)
+			}))
+			srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			srv.Start()
+			defer srv.Close()
+
+			s := New()
+			s.Rate = 0
+			s.Concurrency = 4
+			s.Method = http.MethodGet
+			s.NoDrain = bench.noDrain
+			urls := make([]string, b.N)
+			for i := range urls {
+				urls[i] = fmt.Sprintf("%s/%d", srv.URL, i)
+			}
+			b.ResetTimer()
+			results, err := s.Scan(context.Background(), urls)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for r := range results {
+				if r.Err != nil {
+					b.Fatal(r.Err)
+				}
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(conns.Load())/float64(b.N), "conns/op")
+		})
+	}
+}
+
+func TestScanCancelWithoutReading(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	s := New()
+	s.Rate = 0
+	s.Concurrency = 4
+	urls := make([]string, 4*resultBuffer)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("%s/%d", srv.URL, i)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	results, err := s.Scan(ctx, urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Let the buffer fill so every worker is stuck sending, then give up
+	deadline := time.Now().Add(5 * time.Second)
+	for len(results) < cap(results) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(100 * time.Millisecond) // Workers blocked on a send give up
+
+	// Only what was already buffered is left; nothing is still waiting to
+	// be sent, and the channel is closed
+	for n := len(results); n > 0; n-- {
+		<-results
+	}
+	select {
+	case r, ok := <-results:
+		if ok {
+			t.Fatalf("a worker was still blocked sending %s after cancelling", r.URL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed 5s after cancelling")
+	}
+}
+
+func TestLoadGeoDB(t *testing.T) {
+	dir := t.TempDir()
+	tsv := filepath.Join(dir, "ip2asn-combined.tsv")
+	data := "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+		"2001:db8::\t2001:db8::ffff\t64496\tNL\tEXAMPLE\n" +
+		"10.0.0.0\t10.255.255.255\t0\tNone\tNot routed\n"
+	if err := os.WriteFile(tsv, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadGeoDB(tsv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]string{"1.0.0.1": "13335", "::ffff:1.0.0.200": "13335", "2001:db8::1": "64496", "10.1.2.3": "", "8.8.8.8": ""} {
+		r, _ := db.lookup(ip)
+		if r.asn != want {
+			t.Errorf("lookup(%s) = AS%q, want AS%q", ip, r.asn, want)
+		}
+	}
+
+	// Broken MaxMind files and other binary files are rejected, whatever they're called
+	for name, data := range map[string]string{
+		"GeoLite2-ASN.mmdb": "\x00\x00\x01\x00\x00\x02\xab\xcd\xefMaxMind.com",
+		"geo.db":            "\x00\x00\x01\x00\x00\x02\xab\xcd\xefMaxMind.com\xe1\x42hi\x01",
+		"empty.mmdb":        "",
+		"blob.bin":          "\x00\x01\x02\x03",
+	} {
+		bad := filepath.Join(dir, name)
+		if err := os.WriteFile(bad, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadGeoDB(bad); err == nil {
+			t.Errorf("LoadGeoDB(%s) succeeded, want an error", name)
+		}
+	}
+}
+
+// Encoders for the MaxMind DB data section, enough to build test databases
+func mmdbString(s string) []byte {
+	if len(s) >= 29 {
+		return append([]byte{2<<5 | 29, byte(len(s) - 29)}, s...) // Up to 284 bytes
+	}
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+func mmdbUint16(n uint16) []byte { return []byte{5<<5 | 2, byte(n >> 8), byte(n)} }
+func mmdbUint32(n uint32) []byte {
+	return []byte{6<<5 | 4, byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}
+}
+func mmdbPointer(off int) []byte { return []byte{1<<5 | byte(off>>8), byte(off)} }
+func mmdbMap(pairs ...[]byte) []byte {
+	return append([]byte{7<<5 | byte(len(pairs)/2)}, bytes.Join(pairs, nil)...)
+}
+
+// buildMMDB returns a MaxMind DB with the given IP version and record size
+// mapping each prefix to its encoded record. The data section starts with
+// the string "iso_code", so records can point to it at offset 0
+func buildMMDB(ipVersion, recordSize int, prefixes []string, records [][]byte) []byte {
+	data := mmdbString("iso_code")
+	offsets := make([]int, len(records))
+	for i, record := range records {
+		offsets[i] = len(data)
+		data = append(data, record...)
+	}
+
+	// Children are 0 for no data, node indexes, or -(entry+1) for a leaf
+	nodes := [][2]int{{}}
+	for i, prefix := range prefixes {
+		p := netip.MustParsePrefix(prefix)
+		addr, bits := p.Addr().AsSlice(), p.Bits()
+		if ipVersion == 6 && p.Addr().Is4() {
+			addr, bits = append(make([]byte, 12), addr...), bits+96 // ::a.b.c.d
+		}
+		node := 0
+		for bit := 0; bit < bits; bit++ {
+			side := addr[bit/8] >> (7 - bit%8) & 1
+			if bit == bits-1 {
+				nodes[node][side] = -(i + 1)
+				break
+			}
+			if nodes[node][side] == 0 {
+				nodes = append(nodes, [2]int{})
+				nodes[node][side] = len(nodes) - 1
+			}
+			node = nodes[node][side]
+		}
+	}
+	count := len(nodes)
+	value := func(child int) uint32 {
+		switch {
+		case child == 0:
+			return uint32(count)
+		case child < 0:
+			return uint32(count + 16 + offsets[-child-1])
+		}
+		return uint32(child)
+	}
+	var tree []byte
+	for _, n := range nodes {
+		l, r := value(n[0]), value(n[1])
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(l>>16), byte(l>>8), byte(l), byte(r>>16), byte(r>>8), byte(r))
+		case 28:
+			tree = append(tree, byte(l>>16), byte(l>>8), byte(l), byte(l>>24)<<4|byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		case 32:
+			tree = append(tree, byte(l>>24), byte(l>>16), byte(l>>8), byte(l), byte(r>>24), byte(r>>16), byte(r>>8), byte(r))
+		}
+	}
+
+	db := append(tree, make([]byte, 16)...)
+	db = append(db, data...)
+	db = append(db, "\xab\xcd\xefMaxMind.com"...)
+	return append(db, mmdbMap(
+		mmdbString("binary_format_major_version"), mmdbUint16(2),
+		mmdbString("ip_version"), mmdbUint16(uint16(ipVersion)),
+		mmdbString("node_count"), mmdbUint32(uint32(count)),
+		mmdbString("record_size"), mmdbUint16(uint16(recordSize)),
+	)...)
+}
+
+func TestLoadGeoDBMMDB(t *testing.T) {
+	dir := t.TempDir()
+	asn := mmdbMap(
+		mmdbString("autonomous_system_number"), mmdbUint32(13335),
+		mmdbString("autonomous_system_organization"), mmdbString("CLOUDFLARENET"),
+	)
+	country := mmdbMap(mmdbString("country"), mmdbMap(mmdbPointer(0), mmdbString("NL")))
+	for _, tt := range []struct{ ipVersion, recordSize int }{{4, 24}, {6, 24}, {6, 28}, {6, 32}} {
+		prefixes, records := []string{"1.0.0.0/24"}, [][]byte{asn}
+		if tt.ipVersion == 6 {
+			prefixes, records = append(prefixes, "2001:db8::/32"), append(records, country)
+		}
+		file := filepath.Join(dir, fmt.Sprintf("v%d-%d.mmdb", tt.ipVersion, tt.recordSize))
+		if err := os.WriteFile(file, buildMMDB(tt.ipVersion, tt.recordSize, prefixes, records), 0644); err != nil {
+			t.Fatal(err)
+		}
+		db, err := LoadGeoDB(file)
+		if err != nil {
+			t.Fatalf("IPv%d, %d-bit records: %v", tt.ipVersion, tt.recordSize, err)
+		}
+		want := map[string]geoRange{
+			"1.0.0.1":          {asn: "13335", org: "CLOUDFLARENET"},
+			"::ffff:1.0.0.200": {asn: "13335", org: "CLOUDFLARENET"},
+			"1.0.1.1":          {},
+			"2001:db9::1":      {},
+		}
+		if tt.ipVersion == 6 {
+			want["2001:db8::1"] = geoRange{country: "NL"}
+		}
+		for ip, w := range want {
+			r, ok := db.lookup(ip)
+			if ok != (w != geoRange{}) || r != w {
+				t.Errorf("IPv%d, %d-bit records: lookup(%s) = %+v, %v, want %+v", tt.ipVersion, tt.recordSize, ip, r, ok, w)
+			}
+		}
+	}
+
+	// Each field comes from the first database that has it
+	tsv := filepath.Join(dir, "ip2asn.tsv")
+	if err := os.WriteFile(tsv, []byte("2001:db8::\t2001:db8::ffff\t64496\tDE\tEXAMPLE\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	db, err := LoadGeoDB(filepath.Join(dir, "v6-28.mmdb"), tsv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := db.lookup("2001:db8::1"); r.asn != "64496" || r.org != "EXAMPLE" || r.country != "NL" {
+		t.Errorf("combined lookup = %+v, want AS64496 EXAMPLE from the TSV and NL from the MaxMind DB", r)
+	}
+}
+
+func TestFollowMetaCountsRedirects(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/start":
+			http.Redirect(w, r, "/page", http.StatusFound)
+		case "/page":
+			w.Write([]byte(`<html><meta http-equiv="refresh" content="0; url=/moved"></html>`))
+		case "/moved":
+			http.Redirect(w, r, "/end", http.StatusMovedPermanently)
+		case "/end":
+			w.Write([]byte("done"))
+		}
+	}))
+	defer srv.Close()
+
+	s := New()
+	s.Rate = 0
+	s.FollowMeta = true
+	r := scanAll(t, s, srv.URL+"/start")[srv.URL+"/start"]
+	wantChain := []string{srv.URL + "/page", srv.URL + "/moved", srv.URL + "/end"}
+	if r.Err != nil || r.StatusCode != http.StatusOK || r.FinalURL != srv.URL+"/end" {
+		t.Fatalf("got err %v, status %d, final URL %q", r.Err, r.StatusCode, r.FinalURL)
+	}
+	if r.Redirects != len(r.RedirectChain) || strings.Join(r.RedirectChain, " ") != strings.Join(wantChain, " ") {
+		t.Errorf("redirects %d, chain %q, want %d, %q", r.Redirects, r.RedirectChain, len(wantChain), wantChain)
+	}
+}
+
+func TestScanCancelDuringDNSWarmup(t *testing.T) {
+	// Every lookup takes far longer than the test is willing to wait
+	var lookups atomic.Int64
+	defer func(orig func(context.Context, string) ([]string, error)) { lookupHost = orig }(lookupHost)
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		lookups.Add(1)
+		select {
+		case <-time.After(10 * time.Second):
+		case <-ctx.Done():
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	s := New()
+	s.Rate = 0
+	s.CacheDNS = true
+	var urls []string
+	for i := 0; i < 3*dnsWarmupWorkers; i++ {
+		urls = append(urls, fmt.Sprintf("http://host%d.example/", i))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	results, err := s.Scan(ctx, urls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("Scan took %v to return, want it to warm up in the background", d)
+	}
+	for r := range results {
+		t.Errorf("got a result for %s from a cancelled scan", r.URL)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("channel closed %v after starting, want shortly after the 100ms deadline", d)
+	}
+	if n := lookups.Load(); n > dnsWarmupWorkers {
+		t.Errorf("%d lookups started, want no more than the %d workers once cancelled", n, dnsWarmupWorkers)
+	}
+}
\ No newline at end of file